@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ktzanev/mfe/mfe"
+)
+
+// isAncestor reports if the folder is the path itself or one of its parent folders.
+func isAncestor(folder string, path string) bool {
+	relative, err := filepath.Rel(folder, path)
+	return err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator))
+}
+
+// realPath returns the absolute path without symbolic links, that can hide an ancestor.
+// The part of the path that does not exist yet (like a new destination) is kept as is.
+func realPath(name string) (string, error) {
+	absolute, err := filepath.Abs(name)
+	if err != nil {
+		return "", fmt.Errorf("error resolving %s: %w", name, err)
+	}
+	missing := ""
+	for existing := absolute; ; existing = filepath.Dir(existing) {
+		if real, err := filepath.EvalSymlinks(existing); err == nil {
+			return filepath.Join(real, missing), nil
+		}
+		if existing == filepath.Dir(existing) {
+			return absolute, nil
+		}
+		missing = filepath.Join(filepath.Base(existing), missing)
+	}
+}
+
+// realPathOr returns the real path (see realPath), or the path itself if it cannot be resolved.
+func realPathOr(name string) string {
+	if real, err := realPath(name); err == nil {
+		return real
+	}
+	return name
+}
+
+// isLocal reports if the source is a local file or folder, not stdin or a URL.
+func isLocal(sourcePath string) bool {
+	return sourcePath != "-" && !strings.HasPrefix(sourcePath, "http://") && !strings.HasPrefix(sourcePath, "https://")
+}
+
+// checkNotNested returns an error if the destination is the source,
+// or is inside the source folder (the extracted files would be mixed with the backup).
+func checkNotNested(sourcePath string, destination string) error {
+	if !isLocal(sourcePath) {
+		return nil
+	}
+	source, err := realPath(sourcePath)
+	if err != nil {
+		return err
+	}
+	target, err := realPath(destination)
+	if err != nil {
+		return err
+	}
+	if source == target {
+		return fmt.Errorf("the destination %s is the source", destination)
+	}
+	if info, err := os.Stat(source); err == nil && info.IsDir() && isAncestor(source, target) {
+		return fmt.Errorf("the destination %s is inside the source folder %s", destination, sourcePath)
+	}
+	return nil
+}
+
+// checkClean returns an error if the destination must not be removed by --clean:
+// a root folder, the current folder or one of its parents, a folder containing the source,
+// or a file when the files are written to a folder (and a folder when they are written to an archive).
+func checkClean(destination string, sourcePath string, opts mfe.Options) error {
+	if err := opts.CheckDestination(destination); err != nil {
+		return err
+	}
+	absolute, err := realPath(destination)
+	if err != nil {
+		return err
+	}
+
+	if absolute == filepath.Dir(absolute) {
+		return fmt.Errorf("refusing to clean the root folder %s", absolute)
+	}
+	// The current and home folders are resolved too, the destination may be a symbolic link to one of them
+	if cwd, err := os.Getwd(); err == nil && isAncestor(absolute, realPathOr(cwd)) {
+		return fmt.Errorf("refusing to clean %s, it contains the current folder", absolute)
+	}
+	if home, err := os.UserHomeDir(); err == nil && isAncestor(absolute, realPathOr(home)) {
+		return fmt.Errorf("refusing to clean %s, it contains the home folder", absolute)
+	}
+	if isLocal(sourcePath) {
+		source, err := realPath(sourcePath)
+		if err != nil {
+			return err
+		}
+		if isAncestor(absolute, source) {
+			return fmt.Errorf("refusing to clean %s, it contains the source %s", absolute, sourcePath)
+		}
+	}
+	return nil
+}
+
+// cleanDestination removes the destination folder (or archive) and all its content,
+// after a confirmation on the terminal unless force is set.
+// A missing destination is not an error, there is nothing to clean.
+func cleanDestination(destination string, sourcePath string, force bool, opts mfe.Options) error {
+	if _, err := os.Lstat(destination); os.IsNotExist(err) {
+		return nil
+	}
+	if err := checkClean(destination, sourcePath, opts); err != nil {
+		return err
+	}
+
+	if *dryRun {
+		slog.Info("would remove", "dest", destination)
+		return nil
+	}
+
+	// Ask for a confirmation, stdin must be a terminal (and not the source)
+	if !force {
+		if !canConfirm(sourcePath) {
+			return fmt.Errorf("refusing to clean %s without confirmation, use --force", destination)
+		}
+		if !confirm(fmt.Sprintf("Remove %s and all its content?", destination)) {
+			return fmt.Errorf("cleaning of %s cancelled", destination)
+		}
+	}
+
+	if err := os.RemoveAll(destination); err != nil {
+		return fmt.Errorf("error removing %s: %w", destination, err)
+	}
+	slog.Info("removed", "dest", destination)
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ktzanev/mfe/mfe"
+)
+
+func TestCheckClean(t *testing.T) {
+	base := t.TempDir()
+	home := filepath.Join(base, "home", "user")
+	cwd := filepath.Join(base, "work", "current")
+	source := filepath.Join(base, "backups", "course.mbz")
+	for _, folder := range []string{home, cwd, filepath.Dir(source), filepath.Join(base, "output")} {
+		if err := os.MkdirAll(folder, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(source, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home) // the home folder on Windows
+	t.Chdir(cwd)
+
+	tests := []struct {
+		destination string
+		want        string // a part of the error, or empty if the destination can be cleaned
+	}{
+		{string(filepath.Separator), "root folder"},
+		{cwd, "current folder"},
+		{filepath.Dir(cwd), "current folder"},
+		{".", "current folder"},
+		{home, "home folder"},
+		{filepath.Dir(home), "home folder"},
+		{filepath.Dir(source), "contains the source"},
+		{filepath.Join(base, "output"), ""},
+		{filepath.Join(base, "missing"), ""},
+		{filepath.Join(cwd, "output"), ""},
+	}
+	for _, test := range tests {
+		err := checkClean(test.destination, source, mfe.Options{})
+		if test.want == "" && err != nil {
+			t.Errorf("checkClean(%s) = %v, want nil", test.destination, err)
+		}
+		if test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)) {
+			t.Errorf("checkClean(%s) = %v, want an error with %q", test.destination, err, test.want)
+		}
+	}
+
+	// a symbolic link does not hide an ancestor of the source
+	link := filepath.Join(base, "link")
+	if err := os.Symlink(filepath.Dir(source), link); err != nil {
+		t.Skip("symbolic links are not supported:", err)
+	}
+	if err := checkClean(link, source, mfe.Options{}); err == nil {
+		t.Errorf("checkClean(%s) accepted a link to the source folder", link)
+	}
+}
+
+func TestCleanDestination(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "course.mbz")
+
+	// a missing destination has nothing to clean
+	if err := cleanDestination(filepath.Join(t.TempDir(), "missing"), source, true, mfe.Options{}); err != nil {
+		t.Errorf("got %v for a missing destination, want nil", err)
+	}
+
+	// a folder is removed with all its content
+	folder := filepath.Join(t.TempDir(), "output")
+	if err := os.MkdirAll(filepath.Join(folder, "Lecture notes"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(folder, "Lecture notes", "a.pdf"), []byte("first"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cleanDestination(folder, source, true, mfe.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(folder); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("%s was not removed: %v", folder, err)
+	}
+
+	// a regular file is not a destination folder, it is kept
+	archive := filepath.Join(t.TempDir(), "output.zip")
+	if err := os.WriteFile(archive, []byte("zip"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cleanDestination(archive, source, true, mfe.Options{}); err == nil {
+		t.Errorf("cleanDestination(%s) accepted a file as the destination folder", archive)
+	}
+	if _, err := os.Lstat(archive); err != nil {
+		t.Errorf("%s was removed: %v", archive, err)
+	}
+	// nor is a folder the destination archive
+	if err := cleanDestination(filepath.Dir(archive), source, true, mfe.Options{OutputFormat: "zip"}); err == nil {
+		t.Errorf("cleanDestination(%s) accepted a folder as the destination archive", filepath.Dir(archive))
+	}
+
+	// a previous archive is removed
+	if err := cleanDestination(archive, source, true, mfe.Options{OutputFormat: "zip"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(archive); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("%s was not removed: %v", archive, err)
+	}
+}
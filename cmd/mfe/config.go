@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// configFileNames are the names of the config files, searched in the current folder and then in the home folder.
+var configFileNames = []string{".mferc", ".mfe.yaml"}
+
+// configFiles returns the config files that exist, the ones of the current folder first.
+func configFiles() []string {
+	var folders []string
+	if cwd, err := os.Getwd(); err == nil {
+		folders = append(folders, cwd)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		folders = append(folders, home)
+	}
+
+	var files []string
+	seen := make(map[string]bool)
+	for _, folder := range folders {
+		for _, name := range configFileNames {
+			configPath := filepath.Join(folder, name)
+			if info, err := os.Stat(configPath); err == nil && !info.IsDir() && !seen[configPath] {
+				files = append(files, configPath)
+				seen[configPath] = true
+			}
+		}
+	}
+	return files
+}
+
+// loadConfig sets the flags not given on the command line from the config files.
+// A config file is a YAML mapping of the flag names to their values, like "jobs: 4",
+// with a list for the flags that can be repeated, like "exclude: [\"*.mp4\", \"*.tmp\"]".
+// The first file setting a flag wins, so the precedence is: command line, current folder, home folder.
+func loadConfig(flags *pflag.FlagSet) error {
+	// The flags given on the command line
+	given := make(map[string]bool)
+	flags.Visit(func(flag *pflag.Flag) {
+		given[flag.Name] = true
+	})
+
+	for _, configPath := range configFiles() {
+		if err := loadConfigFile(flags, configPath, given); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadConfigFile sets the flags of a config file, except the ones already given.
+// The flags set by the file are added to given.
+func loadConfigFile(flags *pflag.FlagSet, configPath string, given map[string]bool) error {
+	data, err := os.ReadFile(configPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading config file %s: %w", configPath, err)
+	}
+
+	// Decode to nodes, to report the line of the errors
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return fmt.Errorf("%s: %w", configPath, err)
+	}
+	if len(document.Content) == 0 {
+		return nil // an empty file, or only comments
+	}
+	mapping := document.Content[0]
+	if mapping.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s:%d: expected a mapping of flag names to values, like \"jobs: 4\"", configPath, mapping.Line)
+	}
+
+	set := make(map[string]bool)
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		key, value := mapping.Content[i], mapping.Content[i+1]
+		name := key.Value
+		flag := flags.Lookup(name)
+		if flag == nil {
+			return fmt.Errorf("%s:%d: unknown flag %q", configPath, key.Line, name)
+		}
+		if seen[name] {
+			return fmt.Errorf("%s:%d: %s is set twice (a flag that can be repeated takes a list)", configPath, key.Line, name)
+		}
+		seen[name] = true
+		if given[name] {
+			continue
+		}
+
+		// A list sets a repeatable flag once for each item
+		values := []*yaml.Node{value}
+		if value.Kind == yaml.SequenceNode {
+			if !isRepeatable(flag) {
+				return fmt.Errorf("%s:%d: %s cannot be repeated, expected a single value", configPath, value.Line, name)
+			}
+			values = value.Content
+		}
+		for _, item := range values {
+			if item.Kind != yaml.ScalarNode || item.Tag == "!!null" {
+				return fmt.Errorf("%s:%d: expected a value for %s", configPath, item.Line, name)
+			}
+			if err := flags.Set(name, item.Value); err != nil {
+				return fmt.Errorf("%s:%d: invalid value %q for %s: %w", configPath, item.Line, item.Value, name, err)
+			}
+		}
+		set[name] = true
+	}
+
+	for name := range set {
+		given[name] = true
+	}
+	return nil
+}
+
+// isRepeatable reports if the flag can be given several times, like --include.
+func isRepeatable(flag *pflag.Flag) bool {
+	return strings.HasSuffix(flag.Value.Type(), "Slice") || strings.HasSuffix(flag.Value.Type(), "Array")
+}
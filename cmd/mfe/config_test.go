@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+// testFlags returns a flag set with some flags of each kind.
+func testFlags() *pflag.FlagSet {
+	flags := pflag.NewFlagSet("mfe", pflag.ContinueOnError)
+	flags.Int("jobs", 1, "")
+	flags.Bool("sections", false, "")
+	flags.String("on-collision", "skip", "")
+	flags.StringArray("exclude", nil, "")
+	flags.StringSlice("only-ids", nil, "")
+	return flags
+}
+
+// writeConfig writes a config file in a temporary folder and returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	configPath := filepath.Join(t.TempDir(), ".mfe.yaml")
+	if err := os.WriteFile(configPath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return configPath
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	flags := testFlags()
+	if err := flags.Parse([]string{"--jobs", "8"}); err != nil {
+		t.Fatal(err)
+	}
+	given := map[string]bool{"jobs": true}
+	configPath := writeConfig(t, `---
+# the command line wins
+jobs: 4
+sections: true
+on-collision: "rename"
+exclude: ["*.mp4", "*.tmp"]
+only-ids:
+  - 12
+  - 15
+`)
+
+	if err := loadConfigFile(flags, configPath, given); err != nil {
+		t.Fatal(err)
+	}
+	if jobs, _ := flags.GetInt("jobs"); jobs != 8 {
+		t.Errorf("got jobs %d, want 8 from the command line", jobs)
+	}
+	if sections, _ := flags.GetBool("sections"); !sections {
+		t.Error("sections is not set")
+	}
+	if policy, _ := flags.GetString("on-collision"); policy != "rename" {
+		t.Errorf("got on-collision %q, want rename", policy)
+	}
+	if exclude, _ := flags.GetStringArray("exclude"); !slices.Equal(exclude, []string{"*.mp4", "*.tmp"}) {
+		t.Errorf("got exclude %q, want [*.mp4 *.tmp]", exclude)
+	}
+	if ids, _ := flags.GetStringSlice("only-ids"); !slices.Equal(ids, []string{"12", "15"}) {
+		t.Errorf("got only-ids %q, want [12 15]", ids)
+	}
+	if !given["sections"] || !given["exclude"] {
+		t.Errorf("the flags set by the file are not given: %v", given)
+	}
+
+	// a next file does not override the flags set by the first one
+	if err := loadConfigFile(flags, writeConfig(t, "sections: false\nexclude: \"*.pdf\"\n"), given); err != nil {
+		t.Fatal(err)
+	}
+	if exclude, _ := flags.GetStringArray("exclude"); len(exclude) != 2 {
+		t.Errorf("got exclude %q, want the values of the first file", exclude)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string // a part of the error
+	}{
+		{"jobs: 4\nunknown: 1\n", ":2: unknown flag \"unknown\""},
+		{"jobs: many\n", ":1: invalid value \"many\" for jobs"},
+		{"jobs: [1, 2]\n", ":1: jobs cannot be repeated"},
+		{"\nsections:\n", ":2: expected a value for sections"},
+		{"- jobs\n", ":1: expected a mapping"},
+		{"jobs = 4\n", ":1: expected a mapping"},
+		{"jobs: 4\njobs: 5\n", ":2: jobs is set twice"},
+	}
+	for _, test := range tests {
+		err := loadConfigFile(testFlags(), writeConfig(t, test.content), make(map[string]bool))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("got %v for %q, want an error with %q", err, test.content, test.want)
+		}
+	}
+
+	// an empty file sets nothing
+	if err := loadConfigFile(testFlags(), writeConfig(t, "# nothing yet\n"), make(map[string]bool)); err != nil {
+		t.Errorf("got %v for an empty file", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Thresholds of a large extraction, that is confirmed before starting.
+const (
+	largeFileCount = 1000
+	largeByteCount = 1 << 30 // 1 GiB
+)
+
+// errCancelled is the error of an extraction that is not confirmed.
+var errCancelled = errors.New("extraction cancelled")
+
+// canConfirm reports if a confirmation can be asked: stdin is a terminal and not the source.
+func canConfirm(sourcePath string) bool {
+	return sourcePath != "-" && isTerminal(os.Stdin)
+}
+
+// confirm asks a yes/no question on the terminal, and reports if the answer is yes (no by default).
+// The question is printed on stderr, to keep stdout for the output (like the summary).
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// confirmLarge asks for a confirmation before the extraction of this number of files and bytes,
+// if it is large, and reports if it can start.
+// Without a terminal to ask, the extraction starts unless --non-interactive is abort.
+func confirmLarge(sourcePath string, destination string, files int, bytes int64) bool {
+	if files < largeFileCount && bytes < largeByteCount {
+		return true
+	}
+
+	question := fmt.Sprintf("This will create %d files (%s) in %s. Continue?", files, formatBytes(bytes), destination)
+	if !canConfirm(sourcePath) {
+		if *noTerminal == "abort" {
+			fmt.Fprintf(os.Stderr, "%s No terminal to confirm, aborting (use --yes to continue)\n", question)
+			return false
+		}
+		return true
+	}
+	return confirm(question)
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestConfirmLarge(t *testing.T) {
+	// no confirmation can be asked when stdin is the source
+	defer func(value string) { *noTerminal = value }(*noTerminal)
+	tests := []struct {
+		files      int
+		bytes      int64
+		noTerminal string
+		want       bool
+	}{
+		{10, 1 << 20, "abort", true}, // not large
+		{largeFileCount, 0, "abort", false},
+		{10, largeByteCount, "abort", false},
+		{largeFileCount, largeByteCount, "continue", true},
+	}
+	for _, test := range tests {
+		*noTerminal = test.noTerminal
+		if got := confirmLarge("-", "output", test.files, test.bytes); got != test.want {
+			t.Errorf("confirmLarge(%d files, %d bytes) with --non-interactive=%s = %v, want %v", test.files, test.bytes, test.noTerminal, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,744 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ktzanev/mfe/mfe"
+	"github.com/spf13/pflag"
+)
+
+var (
+	// version is set at build time with -ldflags "-X main.version=..."
+	version       = "dev"
+	showVersion   = pflag.BoolP("version", "v", false, "Print the version and exit")
+	debug         = pflag.BoolP("debug", "d", false, "Enable debug mode (same as --log-level=debug)")
+	verbose       = pflag.BoolP("verbose", "V", false, "Print the per-file progress (same as --log-level=verbose)")
+	quiet         = pflag.BoolP("quiet", "q", false, "Print only the warnings and the summary (same as --log-level=warn)")
+	dryRun        = pflag.BoolP("dry-run", "n", false, "Report what would be created without writing anything")
+	jobs          = pflag.IntP("jobs", "j", runtime.NumCPU(), "Number of files copied in parallel")
+	dedup         = pflag.String("dedup", "", "Deduplicate files with the same content: hardlink")
+	onCollision   = pflag.String("on-collision", "skip", "What to do when a destination file already exists: skip, rename, overwrite or newer")
+	manifestPath  = pflag.String("manifest", "", "Write a JSON manifest of the extracted files to this path")
+	include       = pflag.StringArray("include", nil, "Copy only the files whose name matches this glob pattern (repeatable)")
+	exclude       = pflag.StringArray("exclude", nil, "Do not copy the files whose name matches this glob pattern (repeatable)")
+	autoName      = pflag.Bool("auto-name", false, "Extract to a subfolder of the destination named after the course (also when the destination ends with /)")
+	verify        = pflag.Bool("verify", false, "Check the SHA-1 of each copied file against its content hash")
+	flat          = pflag.Bool("flat", false, "Copy all the files directly in the destination folder (renaming on collision by default)")
+	preserveTimes = pflag.Bool("preserve-times", false, "Set the modification time of the copied files from the backup")
+	ascii         = pflag.Bool("ascii", false, "Transliterate the folder and file names to ASCII (é→e)")
+	keepUnicode   = pflag.Bool("no-nfc", false, "Do not normalize the file names to the Unicode NFC form")
+	lowMemory     = pflag.Bool("low-memory", false, "Decompress .mbz files to a temporary file instead of memory")
+	activityTypes = pflag.StringSlice("activity-types", mfe.DefaultActivityTypes, "Comma-separated activity types whose files are grouped in a folder (e.g. folder,resource,assign)")
+	only          = pflag.Bool("only", false, "Copy only the files of the --activity-types activities")
+	list          = pflag.BoolP("list", "l", false, "Print the tree of the files that would be extracted and exit (no destination needed)")
+	check         = pflag.Bool("check", false, "Check that the backup is complete (no truncated archive or missing file content) and exit (no destination needed)")
+	diff          = pflag.Bool("diff", false, "Print which files would be new, the same or changed in the destination folder and exit (nothing is written)")
+	reportOrphans = pflag.Bool("report-orphans", false, "Print the blobs of the files folder that no file refers to, and exit (no destination needed)")
+	reportDupes   = pflag.Bool("report-dupes", false, "Print the filenames shared by several files, even in different folders, and exit (no destination needed)")
+	minSize       = pflag.Int64("min-size", 0, "Copy only the files of at least this size in bytes")
+	maxSize       = pflag.Int64("max-size", 0, "Copy only the files of at most this size in bytes (0 for no limit)")
+	includeSystem = pflag.Bool("include-system", false, "Also copy the system files (previews, user and group pictures, drafts)")
+	logLevel      = pflag.String("log-level", "info", "Minimum level of the log messages: debug, verbose, info, warn or error")
+	logFormat     = pflag.String("log-format", "text", "Format of the log messages: text or json")
+	fixExtensions = pflag.Bool("fix-extensions", false, "Append the extension of the mimetype to the filenames without extension")
+	sidecar       = pflag.Bool("sidecar", false, "Write the Moodle metadata of each copied file to <filename>.mfe.json")
+	outputFormat  = pflag.String("output-format", "dir", "Write the files to the destination folder (dir), or to a single tar or zip archive at the destination")
+	showProgress  = pflag.Bool("progress", false, "Show a progress bar (only on a terminal and without --quiet)")
+	retries       = pflag.Int("retries", 0, "Retry a failed copy up to this number of times, with an exponential backoff")
+	maxDepth      = pflag.Int("max-depth", 0, "Maximum number of nested folders, the deeper folders are joined with underscores (0 for no limit)")
+	maxNameLen    = pflag.Int("max-name-len", mfe.DefaultMaxNameLen, "Maximum length in bytes of the folder and file names, the longer names are truncated")
+	timeout       = pflag.Duration("timeout", 0, "Time limit of the download of a source URL, like 30s or 5m (no limit if 0)")
+	looseFilesDir = pflag.String("loose-files-dir", "", "Folder of the files that are not in an activity folder (like _loose)")
+	excludeEmpty  = pflag.Bool("exclude-empty", false, "Do not copy the empty files")
+	onlyNames     = pflag.StringSlice("only-names", nil, "Copy only the files whose name matches one of these comma-separated glob patterns")
+	onlyIDs       = pflag.StringSlice("only-ids", nil, "Copy only the files with these comma-separated IDs")
+	tmpDir        = pflag.String("tmp-dir", "", "Folder of the temporary files of stdin, URL and --low-memory sources (default $TMPDIR or the system temporary folder)")
+	root          = pflag.String("root", "", "Folder of the backup inside the source (like backup for backup/files.xml)")
+	reportPath    = pflag.String("report", "", "Also write the warnings, errors and skipped files to this file")
+	clean         = pflag.Bool("clean", false, "Remove the destination folder before extracting, after a confirmation")
+	force         = pflag.Bool("force", false, "Do not ask for a confirmation with --clean")
+	since         = pflag.String("since", "", "Copy only the files modified since this date (YYYY-MM-DD, in the local time zone)")
+	byUser        = pflag.Bool("by-user", false, "Group the files submitted to the assignments in <assignment>/Submissions/<username>/")
+	externals     = pflag.String("externals", "skip", "What to do with the files of external repositories (not in the backup): skip, or shortcut to write a .url shortcut")
+	noConfig      = pflag.Bool("no-config", false, "Do not read the default flags from the .mferc and .mfe.yaml config files")
+	keepJunk      = pflag.Bool("keep-junk", false, "Also copy the metadata files of macOS and Windows (.DS_Store, ._*, __MACOSX/, Thumbs.db, desktop.ini)")
+	yes           = pflag.BoolP("yes", "y", false, "Do not ask for a confirmation before a large extraction (1000 files or 1 GiB)")
+	noTerminal    = pflag.String("non-interactive", "continue", "What to do with a large extraction when no confirmation can be asked (stdin is not a terminal): continue or abort")
+	nameTemplate  = pflag.String("name-template", "", "Go template of the destination path of the files, like \"{{.Folder}}/{{.ID}}-{{.Filename}}\"")
+	preserveIDs   = pflag.String("preserve-ids", "", "Add the Moodle ID of each file to its filename: prefix (123_name.pdf) or suffix (name_123.pdf)")
+	timestamp     = pflag.Bool("timestamp", false, "Extract to a subfolder of the destination named <course short name>_<backup date> (like EX_2024-01-01)")
+	dereference   = pflag.Bool("dereference", false, "Copy the content of the file an alias (shortcut) refers to, under the name of the alias")
+	caseFold      = pflag.Bool("case-insensitive", runtime.GOOS == "windows" || runtime.GOOS == "darwin", "Detect the collisions of the file names that differ only by case (default on Windows and macOS)")
+	folderPrefix  = pflag.String("folder-as-prefix", "", "Prefix the filenames with their folders joined by this separator (like \" - \") instead of creating subfolders")
+	safe          = pflag.Bool("safe", false, "For network filesystems (NFS, SMB): copy one file at a time, without hardlinks, and create the files exclusively")
+	orphans       = pflag.Bool("orphans", false, "Also copy the blobs that no file refers to, to _orphans/<hash>")
+	uniqueContent = pflag.Bool("unique-content", false, "Copy each content only once, whatever its folder and name (the first file in the Moodle order wins)")
+	lowercase     = pflag.Bool("lowercase", false, "Lowercase the folder and file names, including the extensions")
+	sections      = pflag.Bool("sections", false, "Group files by course section (Topic 1/, Topic 2/, ...)")
+)
+
+// Exit codes, besides 0 for success and 130 for an interrupted extraction
+const (
+	exitFailure   = 1 // some files failed to copy, or another error
+	exitUsage     = 2 // invalid arguments, flags or config file
+	exitBadSource = 3 // the source is not found, not supported or not a Moodle backup
+)
+
+// exitCode returns the exit code of an error: exitBadSource for the errors of the source, otherwise exitFailure.
+func exitCode(err error) int {
+	if errors.Is(err, mfe.ErrSourceNotFound) || errors.Is(err, mfe.ErrUnsupportedSource) || errors.Is(err, mfe.ErrNotBackup) {
+		return exitBadSource
+	}
+	return exitFailure
+}
+
+// sourceOptions are the settings of the opening of the sources, set by getArguments.
+var sourceOptions mfe.SourceOptions
+
+func getArguments() ([]string, string, mfe.Options) {
+	// Define command-line flags
+	pflag.Usage = func() {
+		fmt.Println("Usage: mfe <source>... <destination_folder>")
+		fmt.Println("       mfe --list <source>...")
+		fmt.Println("       mfe --report-dupes <source>...")
+		fmt.Println("       mfe --report-orphans <source>...")
+		fmt.Println("       mfe --check <source>...")
+		fmt.Printf("Moodle File Extractor (%s): extract all files from a .mbz Moodle backup file.\n", version)
+		fmt.Println("Options:")
+		fmt.Println("  <source>             Path to .mbz file or extracted folder (- to read a .mbz file from stdin, or an http(s):// URL)")
+		fmt.Println("  <destination_folder> Path to destination folder (with several sources, each one goes to a subfolder named after its course)")
+		pflag.PrintDefaults()
+	}
+
+	// Parse command-line flags, then the config files for the flags not given
+	pflag.Parse()
+	if !*noConfig {
+		if err := loadConfig(pflag.CommandLine); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitUsage)
+		}
+	}
+
+	// Print the version and exit
+	if *showVersion {
+		fmt.Printf("mfe %s\n", version)
+		os.Exit(0)
+	}
+
+	// Get the arguments: the sources, then the destination unless it is not needed
+	args := pflag.Args()
+	if *list || *reportDupes || *reportOrphans || *check {
+		args = append(args, "")
+	}
+	if len(args) < 2 {
+		pflag.Usage()
+		os.Exit(exitUsage)
+	}
+	sourcePaths, destinationFolder := args[:len(args)-1], args[len(args)-1]
+	// stdin can be read only once
+	if i := slices.Index(sourcePaths, "-"); i >= 0 && slices.Contains(sourcePaths[i+1:], "-") {
+		fmt.Fprintln(os.Stderr, "Error: stdin (-) can be used only once as source")
+		os.Exit(exitUsage)
+	}
+
+	// Check the flag values
+	opts := mfe.Options{
+		Sections:        *sections,
+		DryRun:          *dryRun,
+		Jobs:            *jobs,
+		Dedup:           *dedup,
+		OnCollision:     *onCollision,
+		Include:         *include,
+		Exclude:         *exclude,
+		Verify:          *verify,
+		Flat:            *flat,
+		PreserveTimes:   *preserveTimes,
+		ASCII:           *ascii,
+		KeepUnicodeForm: *keepUnicode,
+		OnlyActivities:  *only,
+		MinSize:         *minSize,
+		MaxSize:         *maxSize,
+		IncludeSystem:   *includeSystem,
+		FixExtensions:   *fixExtensions,
+		Sidecar:         *sidecar,
+		OutputFormat:    *outputFormat,
+		Retries:         *retries,
+		MaxDepth:        *maxDepth,
+		MaxNameLen:      *maxNameLen,
+		LooseFilesDir:   *looseFilesDir,
+		ExcludeEmpty:    *excludeEmpty,
+		OnlyIDs:         *onlyIDs,
+		ByUser:          *byUser,
+		Externals:       *externals,
+		KeepJunk:        *keepJunk,
+		NameTemplate:    *nameTemplate,
+		PreserveIDs:     *preserveIDs,
+		Dereference:     *dereference,
+		CaseInsensitive: *caseFold,
+		FolderPrefix:    *folderPrefix,
+		Safe:            *safe,
+		Orphans:         *orphans,
+		UniqueContent:   *uniqueContent,
+		Lowercase:       *lowercase,
+	}
+	// --only-names is a comma-separated shorthand of --include
+	opts.Include = append(opts.Include, *onlyNames...)
+	// in flat mode, rename on collision unless a policy is given
+	if *flat && !pflag.CommandLine.Changed("on-collision") {
+		opts.OnCollision = ""
+	}
+	if pflag.CommandLine.Changed("activity-types") {
+		opts.ActivityTypes = *activityTypes
+	}
+	if *since != "" {
+		date, err := time.ParseInLocation("2006-01-02", *since, time.Local)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid --since date %q, use YYYY-MM-DD\n", *since)
+			os.Exit(exitUsage)
+		}
+		opts.Since = date
+	}
+	if *noTerminal != "continue" && *noTerminal != "abort" {
+		fmt.Fprintf(os.Stderr, "Error: invalid --non-interactive value %q, use one of: continue, abort\n", *noTerminal)
+		os.Exit(exitUsage)
+	}
+	if err := opts.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+	logger, err := newLogger()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitUsage)
+	}
+	// collect the messages of the report on top of the logs
+	if *reportPath != "" {
+		errorReport = &report{}
+		logger = slog.New(reportHandler{Handler: logger.Handler(), report: errorReport})
+	}
+	slog.SetDefault(logger)
+	mfe.Logger = logger
+	sourceOptions = mfe.SourceOptions{
+		Root:        *root,
+		SpoolToDisk: *lowMemory,
+		TempDir:     *tmpDir,
+		HTTPTimeout: *timeout,
+	}
+
+	return sourcePaths, destinationFolder, opts
+}
+
+// newLogger returns the logger to stderr set by --log-format and --log-level (or --debug and --quiet).
+func newLogger() (*slog.Logger, error) {
+	var level slog.Level
+	if *logLevel == "verbose" {
+		level = mfe.LevelVerbose
+	} else if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return nil, fmt.Errorf("invalid --log-level value %q, use one of: debug, verbose, info, warn, error", *logLevel)
+	}
+	if *debug {
+		level = slog.LevelDebug
+	} else if *verbose {
+		level = mfe.LevelVerbose
+	} else if *quiet {
+		level = slog.LevelWarn
+	}
+
+	// Name the verbose level (instead of DEBUG+2)
+	replaceLevel := func(groups []string, attr slog.Attr) slog.Attr {
+		if level, ok := attr.Value.Any().(slog.Level); ok && attr.Key == slog.LevelKey && len(groups) == 0 {
+			attr.Value = slog.StringValue(levelName(level))
+		}
+		return attr
+	}
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: replaceLevel}
+	switch *logFormat {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, options)), nil
+	}
+	return nil, fmt.Errorf("invalid --log-format value %q, use one of: text, json", *logFormat)
+}
+
+// levelName returns the name of a log level, VERBOSE for mfe.LevelVerbose.
+func levelName(level slog.Level) string {
+	if level == mfe.LevelVerbose {
+		return "VERBOSE"
+	}
+	return level.String()
+}
+
+// run extracts the files from the source to the destination folder and returns the exit code.
+// The deferred functions (like closing the source) are run before exiting.
+// With --clean, the destinations already cleaned for a previous source (like a backup of the same course)
+// are in cleaned, they are not cleaned again, and the destination of the source is added to it.
+func run(sourcePath string, destinationFolder string, subfolder bool, opts mfe.Options, cleaned map[string]bool) int {
+	// get the source filesystem
+	source, close, err := mfe.GetSource(sourcePath, sourceOptions)
+	if err != nil {
+		slog.Error("error getting source", "error", err)
+		return exitCode(err)
+	}
+	if close != nil {
+		defer func() {
+			if err := close(); err != nil {
+				slog.Error("error closing source", "error", err)
+			}
+		}()
+	}
+
+	// read the backup information
+	info, err := mfe.ReadBackupInfo(source)
+	if err != nil {
+		slog.Debug("no backup information", "error", err)
+	}
+	for _, note := range info.CompatibilityNotes() {
+		slog.Warn("compatibility note", "moodle", info.MoodleRelease, "note", note)
+	}
+
+	destinationFolder = courseDestination(info, sourcePath, destinationFolder, subfolder)
+
+	// never write into the source
+	if err := checkNotNested(sourcePath, destinationFolder); err != nil {
+		slog.Error("invalid destination", "error", err)
+		return 1
+	}
+	// a file instead of a folder (or the reverse) is refused before asking anything or cleaning it
+	if err := opts.CheckDestination(destinationFolder); err != nil {
+		slog.Error("invalid destination", "error", err)
+		return 1
+	}
+
+	// once the files are mapped (without mapping them twice): confirm the large extractions,
+	// then start from an empty destination
+	opts.BeforeCopy = func(files int, bytes int64) error {
+		if !*yes && !*dryRun && !confirmLarge(sourcePath, destinationFolder, files, bytes) {
+			return errCancelled
+		}
+		// the sources of the same course are merged, the files of the previous ones are kept
+		if key := realPathOr(destinationFolder); *clean && !cleaned[key] {
+			if err := cleanDestination(destinationFolder, sourcePath, *force, opts); err != nil {
+				return fmt.Errorf("error cleaning the destination: %w", err)
+			}
+			cleaned[key] = true
+		}
+		return nil
+	}
+
+	// extract the files to the destination folder
+	// show the progress on a terminal
+	var bar *progressBar
+	if *showProgress && !*quiet && isTerminal(os.Stderr) {
+		bar = &progressBar{output: os.Stderr}
+		opts.Progress = bar.update
+	}
+	// stop between files on Ctrl-C (the file being copied is removed), a second Ctrl-C exits at once
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	result, err := mfe.Extract(ctx, source, destinationFolder, opts)
+	if bar != nil {
+		bar.finish()
+	}
+	if errors.Is(err, errCancelled) {
+		fmt.Fprintln(os.Stderr, "Extraction cancelled")
+		return 1
+	}
+	if errors.Is(err, context.Canceled) {
+		fmt.Printf("Interrupted after copying %d files (%d bytes) to %s\n", result.Copied, result.Bytes, destinationFolder)
+		return 130
+	}
+	if err != nil && !errors.Is(err, mfe.ErrCopyFailed) {
+		slog.Error("error extracting the files", "error", err)
+		return exitCode(err)
+	}
+	copyErr := err
+
+	// this is the end
+	if *dryRun {
+		fmt.Printf("Would copy %d (%d bytes), skip %d%s, missing %d files to %s\n", result.Copied, result.Bytes, result.Skipped, skippedDetails(result.Stats), result.Missing, destinationFolder)
+	} else {
+		fmt.Printf("Copied %d (%d bytes), skipped %d%s, missing %d, failed %d files to %s in %s\n", result.Copied, result.Bytes, result.Skipped, skippedDetails(result.Stats), result.Missing, result.Failed, destinationFolder, result.Duration.Round(time.Millisecond))
+	}
+
+	// the number of files by folder, to check the folders found in the backup
+	if !*quiet {
+		printFolders(result.Folders)
+	}
+
+	// exit with an error if some files failed to copy
+	if copyErr != nil {
+		slog.Error(mfe.ErrCopyFailed.Error(), "failed", result.Failed, "ids", strings.Join(result.FailedIDs, ","))
+		return 1
+	}
+
+	return 0
+}
+
+// skippedDetails returns the number of skipped empty and old files to add to the summary, if any.
+func skippedDetails(stats mfe.Stats) string {
+	var details []string
+	if stats.Empty > 0 {
+		details = append(details, fmt.Sprintf("%d empty", stats.Empty))
+	}
+	if stats.Old > 0 {
+		details = append(details, fmt.Sprintf("%d older than --since", stats.Old))
+	}
+	if stats.Duplicates > 0 {
+		details = append(details, fmt.Sprintf("%d duplicate content", stats.Duplicates))
+	}
+	if len(details) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(details, ", ") + ")"
+}
+
+// printFolders prints the number of files of each folder, by decreasing number of files.
+func printFolders(folders map[string]int) {
+	names := make([]string, 0, len(folders))
+	for name := range folders {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if folders[names[i]] != folders[names[j]] {
+			return folders[names[i]] > folders[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names {
+		if name == "" {
+			fmt.Printf("%6d  (top folder)\n", folders[name])
+		} else {
+			fmt.Printf("%6d  %s/\n", folders[name], name)
+		}
+	}
+}
+
+// listFiles prints the tree of the files that would be extracted and returns the exit code.
+func listFiles(sourcePath string, opts mfe.Options) int {
+	// get the source filesystem
+	source, close, err := mfe.GetSource(sourcePath, sourceOptions)
+	if err != nil {
+		slog.Error("error getting source", "error", err)
+		return exitCode(err)
+	}
+	if close != nil {
+		defer func() {
+			if err := close(); err != nil {
+				slog.Error("error closing source", "error", err)
+			}
+		}()
+	}
+
+	entries, err := mfe.List(source, opts)
+	if err != nil {
+		slog.Error("error listing the files", "error", err)
+		return exitCode(err)
+	}
+
+	// print the folders the first time they appear, then the indented file
+	var previous []string
+	for _, entry := range entries {
+		parts := strings.Split(entry.Path, "/")
+		folders := parts[:len(parts)-1]
+		common := 0
+		for common < len(folders) && common < len(previous) && folders[common] == previous[common] {
+			common++
+		}
+		for depth := common; depth < len(folders); depth++ {
+			fmt.Printf("%s%s/\n", strings.Repeat("  ", depth), folders[depth])
+		}
+		size := "missing"
+		if entry.Size >= 0 {
+			size = fmt.Sprintf("%d bytes", entry.Size)
+		}
+		fmt.Printf("%s%s (%s)\n", strings.Repeat("  ", len(folders)), parts[len(parts)-1], size)
+		previous = folders
+	}
+
+	return 0
+}
+
+// printDuplicates prints the groups of files with the same filename in the source and returns the exit code.
+func printDuplicates(sourcePath string, opts mfe.Options) int {
+	// get the source filesystem
+	source, close, err := mfe.GetSource(sourcePath, sourceOptions)
+	if err != nil {
+		slog.Error("error getting source", "error", err)
+		return exitCode(err)
+	}
+	if close != nil {
+		defer func() {
+			if err := close(); err != nil {
+				slog.Error("error closing source", "error", err)
+			}
+		}()
+	}
+
+	groups, err := mfe.Duplicates(source, opts)
+	if err != nil {
+		slog.Error("error finding the duplicates", "error", err)
+		return exitCode(err)
+	}
+
+	// print each filename, then its files with their folders
+	for _, files := range groups {
+		fmt.Printf("%s (%d files)\n", files[0].Filename, len(files))
+		for _, file := range files {
+			folder := file.Folder
+			if folder == "" {
+				folder = "."
+			}
+			fmt.Printf("  id=%s hash=%s folder=%s\n", file.ID, file.ContentHash, path.Join(file.Section, folder))
+		}
+	}
+	if len(groups) == 0 {
+		fmt.Println("No duplicate filenames")
+	}
+
+	return 0
+}
+
+// diffFiles prints which files of the source would be new, the same or changed in the destination folder,
+// without writing anything, and returns the exit code.
+func diffFiles(sourcePath string, destinationFolder string, subfolder bool, opts mfe.Options) int {
+	// get the source filesystem
+	source, close, err := mfe.GetSource(sourcePath, sourceOptions)
+	if err != nil {
+		slog.Error("error getting source", "error", err)
+		return exitCode(err)
+	}
+	if close != nil {
+		defer func() {
+			if err := close(); err != nil {
+				slog.Error("error closing source", "error", err)
+			}
+		}()
+	}
+
+	// compare to the folder the source would be extracted to
+	info, err := mfe.ReadBackupInfo(source)
+	if err != nil {
+		slog.Debug("no backup information", "error", err)
+	}
+	destinationFolder = courseDestination(info, sourcePath, destinationFolder, subfolder)
+	entries, err := mfe.Diff(source, destinationFolder, opts)
+	if err != nil {
+		slog.Error("error comparing the files", "error", err)
+		return exitCode(err)
+	}
+
+	// print each file with its status, then the counts
+	counts := make(map[string]int)
+	for _, entry := range entries {
+		fmt.Printf("%-7s  %s\n", entry.Status, entry.Path)
+		counts[entry.Status]++
+	}
+	fmt.Printf("%d new, %d same, %d changed files in %s\n", counts[mfe.DiffNew], counts[mfe.DiffSame], counts[mfe.DiffChanged], destinationFolder)
+	return 0
+}
+
+// printOrphans prints the blobs of the source that no file refers to, and returns the exit code.
+func printOrphans(sourcePath string) int {
+	// get the source filesystem
+	source, close, err := mfe.GetSource(sourcePath, sourceOptions)
+	if err != nil {
+		slog.Error("error getting source", "error", err)
+		return exitCode(err)
+	}
+	if close != nil {
+		defer func() {
+			if err := close(); err != nil {
+				slog.Error("error closing source", "error", err)
+			}
+		}()
+	}
+
+	orphans, err := mfe.Orphans(source)
+	if err != nil {
+		slog.Error("error finding the orphans", "error", err)
+		return exitCode(err)
+	}
+
+	// print each blob, then the totals
+	var size int64
+	for _, orphan := range orphans {
+		fmt.Printf("%s  %d bytes\n", orphan.Hash, orphan.Size)
+		size += orphan.Size
+	}
+	fmt.Printf("%d orphan blobs (%d bytes)\n", len(orphans), size)
+	return 0
+}
+
+// checkBackup checks that the backup is complete, prints the problems and returns the exit code (1 if incomplete).
+func checkBackup(sourcePath string) int {
+	// get the source filesystem, a truncated archive may already fail here
+	source, close, err := mfe.GetSource(sourcePath, sourceOptions)
+	if err != nil {
+		slog.Error("error getting source", "error", err)
+		return exitCode(err)
+	}
+	if close != nil {
+		defer func() {
+			if err := close(); err != nil {
+				slog.Error("error closing source", "error", err)
+			}
+		}()
+	}
+
+	result, err := mfe.Check(source)
+	if err != nil {
+		slog.Error("error checking the backup", "error", err)
+		return exitCode(err)
+	}
+
+	// print the problems, then the verdict
+	if !result.BackupXML {
+		fmt.Println("Missing moodle_backup.xml")
+	}
+	for _, entryPath := range result.Unreadable {
+		fmt.Printf("Unreadable entry %s\n", entryPath)
+	}
+	for _, file := range result.MissingBlobs {
+		fmt.Printf("Missing content of file id=%s hash=%s filename=%s\n", file.ID, file.ContentHash, file.Filename)
+	}
+	status := "complete"
+	if !result.Complete() {
+		status = "incomplete"
+	}
+	fmt.Printf("Backup %s: %d entries read, %d files declared, %d missing, %d external\n", status, result.Entries, result.Files, len(result.MissingBlobs), result.ExternalFiles)
+	if !result.Complete() {
+		return 1
+	}
+	return 0
+}
+
+// extractAll extracts the files of each source, to the destination folder or to its subfolders
+// if there are several sources, and returns the highest exit code.
+// The manifest and the report cover all the sources.
+func extractAll(sourcePaths []string, destinationFolder string, opts mfe.Options) int {
+	// write the report at the very end, to include all the messages
+	if errorReport != nil {
+		defer func() {
+			if err := errorReport.write(*reportPath); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			}
+		}()
+	}
+
+	if *manifestPath != "" {
+		opts.Manifest = &mfe.Manifest{}
+	}
+	// the sources merged in the same destination are deduplicated and resolve their collisions together
+	opts.Session = &mfe.Session{}
+	cleaned := make(map[string]bool)
+	exitCode := 0
+	for _, sourcePath := range sourcePaths {
+		code := run(sourcePath, destinationFolder, len(sourcePaths) > 1, opts, cleaned)
+		exitCode = max(exitCode, code)
+		// stop on Ctrl-C
+		if code == 130 {
+			break
+		}
+	}
+
+	// write the manifest of the extracted files
+	if opts.Manifest != nil {
+		if err := opts.Manifest.Write(*manifestPath); err != nil {
+			slog.Error("error writing the manifest", "error", err)
+			return max(exitCode, 1)
+		}
+	}
+	return exitCode
+}
+
+// courseDestination returns the folder to extract the source to: a subfolder of the destination
+// named after the course (and the backup date with --timestamp) with several sources, --auto-name,
+// --timestamp or a destination ending with /, otherwise the destination itself.
+func courseDestination(info mfe.BackupInfo, sourcePath string, destinationFolder string, subfolder bool) string {
+	if !subfolder && !*autoName && !*timestamp && !strings.HasSuffix(destinationFolder, "/") && !strings.HasSuffix(destinationFolder, string(filepath.Separator)) {
+		return destinationFolder
+	}
+	name := info.FolderName()
+	if *timestamp {
+		name = info.TimestampFolderName()
+	}
+	if name != "" {
+		return filepath.Join(destinationFolder, name)
+	}
+	if subfolder {
+		// each source needs its own subfolder, named after the source without course name
+		return filepath.Join(destinationFolder, sourceName(sourcePath))
+	}
+	slog.Warn("no course name found", "dest", destinationFolder)
+	return destinationFolder
+}
+
+// sourceName returns the name of a source without its extension, like course for /path/course.mbz.
+func sourceName(sourcePath string) string {
+	if sourcePath == "-" {
+		return "stdin"
+	}
+	name := path.Base(filepath.ToSlash(sourcePath))
+	if strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tar.bz2") || strings.HasSuffix(name, ".tar.xz") {
+		name = strings.TrimSuffix(name, path.Ext(name))
+	}
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+// forEachSource runs a mode without destination (like --list) on each source and returns the highest exit code.
+// The name of each source is printed before its output if there are several sources.
+func forEachSource(sourcePaths []string, mode func(sourcePath string) int) int {
+	exitCode := 0
+	for i, sourcePath := range sourcePaths {
+		if len(sourcePaths) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("%s:\n", sourcePath)
+		}
+		exitCode = max(exitCode, mode(sourcePath))
+	}
+	return exitCode
+}
+
+func main() {
+	// get the command-line arguments
+	sourcePaths, destinationFolder, opts := getArguments()
+
+	if *list {
+		os.Exit(forEachSource(sourcePaths, func(sourcePath string) int { return listFiles(sourcePath, opts) }))
+	}
+	if *reportDupes {
+		os.Exit(forEachSource(sourcePaths, func(sourcePath string) int { return printDuplicates(sourcePath, opts) }))
+	}
+	if *reportOrphans {
+		os.Exit(forEachSource(sourcePaths, printOrphans))
+	}
+	if *check {
+		os.Exit(forEachSource(sourcePaths, checkBackup))
+	}
+	if *diff {
+		os.Exit(forEachSource(sourcePaths, func(sourcePath string) int {
+			return diffFiles(sourcePath, destinationFolder, len(sourcePaths) > 1, opts)
+		}))
+	}
+	os.Exit(extractAll(sourcePaths, destinationFolder, opts))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ktzanev/mfe/mfe"
+)
+
+// writeCourse writes an extracted backup of the course with a single file, and returns its folder.
+func writeCourse(t *testing.T, course string, filename string, content string) string {
+	t.Helper()
+	folder := t.TempDir()
+	hash := "0123456789abcdef0123456789abcdef01234567"
+	files := map[string]string{
+		"moodle_backup.xml": "<moodle_backup><information><original_course_fullname>" + course + "</original_course_fullname></information></moodle_backup>",
+		"files.xml":         "<files><file id=\"1\"><contenthash>" + hash + "</contenthash><filepath>/</filepath><filename>" + filename + "</filename></file></files>",
+		"files/01/" + hash:  content,
+	}
+	for name, data := range files {
+		if err := os.MkdirAll(filepath.Join(folder, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(folder, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(folder, "activities"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return folder
+}
+
+func TestExtractAllCleanSameCourse(t *testing.T) {
+	defer func(c, f bool) { *clean, *force = c, f }(*clean, *force)
+	*clean, *force = true, true
+
+	destination := t.TempDir()
+	// a file of a previous extraction, that is removed
+	if err := os.MkdirAll(filepath.Join(destination, "Course"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(destination, "Course", "old.txt"), []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	first := writeCourse(t, "Course", "s1.txt", "first")
+	second := writeCourse(t, "Course", "s2.txt", "second")
+
+	if code := extractAll([]string{first, second}, destination, mfe.Options{Jobs: 1}); code != 0 {
+		t.Fatalf("got exit code %d, want 0", code)
+	}
+	// both sources are merged, the course folder is cleaned only before the first one
+	got := make(map[string]bool)
+	entries, err := os.ReadDir(filepath.Join(destination, "Course"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		got[entry.Name()] = true
+	}
+	if want := map[string]bool{"s1.txt": true, "s2.txt": true}; !maps.Equal(got, want) {
+		t.Errorf("got files %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressInterval is the minimum time between two updates of the progress bar.
+const progressInterval = 100 * time.Millisecond
+
+// isTerminal reports if the file is a terminal (and not a pipe or a regular file).
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// formatBytes formats a number of bytes with a binary unit (like 12.3 MiB).
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, exp := float64(n)/unit, 0
+	for value >= unit && exp < 4 {
+		value /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[exp])
+}
+
+// progressBar draws a progress bar on a single line of the output, stderr to keep stdout for the summary.
+type progressBar struct {
+	output io.Writer
+	mutex  sync.Mutex
+	last   time.Time
+	drawn  bool
+}
+
+// update redraws the progress bar, at most once per progressInterval, it is safe for concurrent use.
+func (p *progressBar) update(done, total int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// Throttle the updates, but always draw the end
+	now := time.Now()
+	if now.Sub(p.last) < progressInterval && done < total {
+		return
+	}
+	p.last = now
+
+	percent := 100
+	if total > 0 {
+		percent = int(min(done*100/total, 100))
+	}
+	bar := strings.Repeat("#", percent/5) + strings.Repeat(".", 20-percent/5)
+	fmt.Fprintf(p.output, "\r[%s] %3d%% %s / %s ", bar, percent, formatBytes(done), formatBytes(total))
+	p.drawn = true
+}
+
+// finish ends the line of the progress bar, if it was drawn.
+func (p *progressBar) finish() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.drawn {
+		fmt.Fprintln(p.output)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{1 << 30, "1.0 GiB"},
+	}
+	for _, test := range tests {
+		if got := formatBytes(test.n); got != test.want {
+			t.Errorf("formatBytes(%d) = %q, want %q", test.n, got, test.want)
+		}
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	var output strings.Builder
+	bar := &progressBar{output: &output}
+
+	bar.update(512, 1024)
+	bar.update(600, 1024) // throttled
+	bar.update(1024, 1024)
+	bar.finish()
+	want := "\r[##########..........]  50% 512 B / 1.0 KiB \r[####################] 100% 1.0 KiB / 1.0 KiB \n"
+	if output.String() != want {
+		t.Errorf("got %q, want %q", output.String(), want)
+	}
+
+	// a bar never drawn does not end a line
+	output.Reset()
+	(&progressBar{output: &output}).finish()
+	if output.Len() != 0 {
+		t.Errorf("got %q for a bar never drawn", output.String())
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/ktzanev/mfe/mfe"
+)
+
+// report collects the warnings, errors and skip messages, to write them to the --report file.
+type report struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+// reported reports whether a log record goes to the report: the warnings, errors and skipped files.
+func reported(record slog.Record) bool {
+	return record.Level >= slog.LevelWarn || (record.Level >= mfe.LevelVerbose && strings.HasPrefix(record.Message, "skipped"))
+}
+
+// add adds a log record to the report, as a line like: WARN missing file id=123 hash=...
+func (r *report) add(record slog.Record) {
+	var line strings.Builder
+	fmt.Fprintf(&line, "%s %s", levelName(record.Level), record.Message)
+	record.Attrs(func(attr slog.Attr) bool {
+		fmt.Fprintf(&line, " %s=%q", attr.Key, attr.Value.String())
+		return true
+	})
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.lines = append(r.lines, line.String())
+}
+
+// write writes the report to the given file, one message per line.
+func (r *report) write(reportPath string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var content strings.Builder
+	for _, line := range r.lines {
+		content.WriteString(line + "\n")
+	}
+	if err := os.WriteFile(reportPath, []byte(content.String()), 0o644); err != nil {
+		return fmt.Errorf("error writing report: %w", err)
+	}
+	return nil
+}
+
+// reportHandler is a log handler that also adds the reported records to a report,
+// whatever the level of the wrapped handler.
+type reportHandler struct {
+	slog.Handler
+	report *report
+}
+
+func (h reportHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= mfe.LevelVerbose || h.Handler.Enabled(ctx, level)
+}
+
+func (h reportHandler) Handle(ctx context.Context, record slog.Record) error {
+	if reported(record) {
+		h.report.add(record)
+	}
+	if !h.Handler.Enabled(ctx, record.Level) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h reportHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return reportHandler{Handler: h.Handler.WithAttrs(attrs), report: h.report}
+}
+
+func (h reportHandler) WithGroup(name string) slog.Handler {
+	return reportHandler{Handler: h.Handler.WithGroup(name), report: h.report}
+}
+
+// errorReport is the report set by --report, or nil.
+var errorReport *report
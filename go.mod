@@ -5,4 +5,7 @@ go 1.24.1
 require (
 	github.com/nlepage/go-tarfs v1.2.1
 	github.com/spf13/pflag v1.0.6
+	github.com/ulikunitz/xz v0.5.12
+	golang.org/x/text v0.26.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,135 @@
+package mfe
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// OutputFormats lists the supported values of the --output-format flag.
+// With tar and zip, the destination is a single archive file instead of a folder.
+var OutputFormats = []string{"dir", "tar", "zip"}
+
+// archiveWriter writes the copied files as the entries of a tar or zip archive.
+// The entries are written one at a time, it is safe for concurrent use.
+type archiveWriter struct {
+	mutex sync.Mutex
+	// base is the path of the archive, the entry names are the destination paths relative to it
+	base string
+	file *os.File
+	tar  *tar.Writer
+	zip  *zip.Writer
+}
+
+// newArchiveWriter creates the archive file of the given format (tar or zip).
+func newArchiveWriter(archivePath string, format string) (*archiveWriter, error) {
+	// Ensure the folder of the archive exists
+	if err := os.MkdirAll(filepath.Dir(archivePath), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("error creating directory %s: %w", filepath.Dir(archivePath), err)
+	}
+
+	// Create the archive file
+	file, err := os.Create(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("error creating archive %s: %w", archivePath, err)
+	}
+	a := &archiveWriter{base: archivePath, file: file}
+	if format == "zip" {
+		a.zip = zip.NewWriter(file)
+	} else {
+		a.tar = tar.NewWriter(file)
+	}
+	Logger.Info("created archive", "dest", archivePath, "format", format)
+	return a, nil
+}
+
+// add writes an entry with the given content to the archive, and returns the number of bytes written.
+// The tar format needs the size of the entry before its content.
+func (a *archiveWriter) add(destinationPath string, size int64, modTime time.Time, content io.Reader) (int64, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// The entry name is the slash-separated path relative to the archive
+	name, err := filepath.Rel(a.base, destinationPath)
+	if err != nil {
+		return 0, err
+	}
+	name = filepath.ToSlash(name)
+
+	// Create the entry
+	var writer io.Writer
+	if a.zip != nil {
+		writer, err = a.zip.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime})
+	} else {
+		err = a.tar.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0o644, Size: size, ModTime: modTime})
+		writer = a.tar
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error adding %s to the archive: %w", name, err)
+	}
+
+	// Write the content of the entry
+	written, err := io.Copy(writer, content)
+	if err != nil {
+		return written, fmt.Errorf("error writing %s to the archive: %w", name, err)
+	}
+	return written, nil
+}
+
+// Close writes the end of the archive and closes the archive file.
+func (a *archiveWriter) Close() error {
+	var err error
+	if a.zip != nil {
+		err = a.zip.Close()
+	} else {
+		err = a.tar.Close()
+	}
+	return errors.Join(err, a.file.Close())
+}
+
+// addToArchive adds a single file to the archive and returns the outcome.
+func (c *copier) addToArchive(file File, sourceFile io.Reader, result copyResult) copyResult {
+	destinationPath := result.Destination
+
+	// Use the modification time of the file from the backup
+	modTime := time.Now()
+	if mtime, ok := file.modificationTime(); ok && c.PreserveTimes {
+		modTime = mtime
+	}
+
+	// Add the file content, hashing it on the fly if it must be verified
+	var reader io.Reader = io.TeeReader(contextReader{ctx: c.ctx, reader: sourceFile}, c.progress)
+	hash := sha1.New()
+	if c.Verify {
+		reader = io.TeeReader(reader, hash)
+	}
+	written, err := c.archive.add(destinationPath, result.Size, modTime, reader)
+	if err != nil {
+		return result.fail(err)
+	}
+	result.Size = written
+	// A size different from the declared one is a sign of a corrupt archive
+	if file.Filesize != unknownSize && written != file.Filesize {
+		Logger.Warn("size mismatch", "id", file.ID, "dest", destinationPath, "size", written, "declared", file.Filesize)
+	}
+
+	// The content hash is the SHA-1 of the content, an entry cannot be removed from the archive
+	if c.Verify {
+		if sum := hex.EncodeToString(hash.Sum(nil)); sum != file.ContentHash {
+			return result.fail(fmt.Errorf("verifying file %s: SHA-1 %s does not match content hash %s (the entry is in the archive)", destinationPath, sum, file.ContentHash))
+		}
+	}
+
+	logVerbose("copied", "id", file.ID, "hash", file.ContentHash, "folder", file.Folder, "dest", destinationPath, "size", written)
+	c.writeSidecar(file, destinationPath)
+	result.Status = statusCopied
+	return result
+}
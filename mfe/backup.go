@@ -0,0 +1,125 @@
+package mfe
+
+import (
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BackupInfo holds the information about the backup from moodle_backup.xml.
+type BackupInfo struct {
+	Name            string    // name of the backup file
+	CourseFullname  string    // full name of the original course
+	CourseShortname string    // short name of the original course
+	BackupDate      time.Time // date of the backup
+	MoodleRelease   string    // release of Moodle that made the backup (like 4.1.2 (Build: 20230313))
+	MoodleVersion   string    // version of Moodle that made the backup (like 2022112802)
+}
+
+// ReadBackupInfo reads the backup information from moodle_backup.xml.
+// The moodle_backup.xml structure is like this:
+// ```xml
+// <moodle_backup>
+//
+//	<information>
+//		<name>backup-moodle2-course-1234-example-20240101-1200.mbz</name>
+//		<moodle_version>2022112802</moodle_version>
+//		<moodle_release>4.1.2 (Build: 20230313)</moodle_release>
+//		<backup_date>1704106800</backup_date>
+//		<original_course_fullname>Example course</original_course_fullname>
+//		<original_course_shortname>EX</original_course_shortname>
+//		...
+//	</information>
+//
+// </moodle_backup>
+// ```
+func ReadBackupInfo(source fs.FS) (BackupInfo, error) {
+	// Open the moodle_backup.xml file
+	backupFile, err := source.Open("moodle_backup.xml")
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("error reading moodle_backup.xml: %w", err)
+	}
+	defer backupFile.Close()
+
+	// Parse the moodle_backup.xml file
+	var backupData struct {
+		Name            string `xml:"information>name"`
+		MoodleVersion   string `xml:"information>moodle_version"`
+		MoodleRelease   string `xml:"information>moodle_release"`
+		BackupDate      int64  `xml:"information>backup_date"`
+		CourseFullname  string `xml:"information>original_course_fullname"`
+		CourseShortname string `xml:"information>original_course_shortname"`
+	}
+	if err := parseXMLFile(backupFile, &backupData); err != nil {
+		return BackupInfo{}, fmt.Errorf("error parsing moodle_backup.xml: %w", err)
+	}
+
+	info := BackupInfo{
+		Name:            backupData.Name,
+		CourseFullname:  backupData.CourseFullname,
+		CourseShortname: backupData.CourseShortname,
+		MoodleRelease:   backupData.MoodleRelease,
+		MoodleVersion:   backupData.MoodleVersion,
+	}
+	if backupData.BackupDate > 0 {
+		info.BackupDate = time.Unix(backupData.BackupDate, 0)
+	}
+	Logger.Debug("backup info", "name", info.Name, "course", info.CourseFullname, "moodle", info.MoodleRelease)
+	return info, nil
+}
+
+// FolderName returns a folder name for the backup, based on the sanitized course full name.
+// It falls back to the short name, and returns an empty string if the course has no name.
+func (info BackupInfo) FolderName() string {
+	if name := sanitizeFileName(info.CourseFullname); name != "" {
+		return name
+	}
+	return sanitizeFileName(info.CourseShortname)
+}
+
+// TimestampFolderName returns a folder name for the backup, based on the sanitized course short name
+// and the date of the backup, like EX_2024-01-01. It falls back to FolderName without short name,
+// the date is omitted if unknown, and it returns an empty string if the course has no name.
+func (info BackupInfo) TimestampFolderName() string {
+	name := sanitizeFileName(info.CourseShortname)
+	if name == "" {
+		name = info.FolderName()
+	}
+	if name == "" || info.BackupDate.IsZero() {
+		return name
+	}
+	return name + "_" + info.BackupDate.Format(time.DateOnly)
+}
+
+// compatibilityNote is a known difference of the backup format for a range of Moodle versions.
+type compatibilityNote struct {
+	from, to int64 // range of the Moodle versions, from included and to excluded, 0 for no bound
+	note     string
+}
+
+// compatibilityNotes are the known differences of the backup format that change what can be extracted.
+// The versions are the ones of the Moodle releases, like 2012062500 for 2.3 and 2025100600 for 5.1.
+var compatibilityNotes = []compatibilityNote{
+	{to: 2012062500, note: "backup made before Moodle 2.3: files.xml has no repository fields, the aliases and external files are not recorded"},
+	{from: 2026000000, note: "backup made after Moodle 5.1, the latest known release: if some files are not mapped as expected, please report it"},
+}
+
+// CompatibilityNotes returns the known differences of the backup format of the Moodle version of the backup,
+// that can explain unexpected results. It returns nothing if the version is unknown.
+func (info BackupInfo) CompatibilityNotes() []string {
+	// The version is like 2022112802, or 2022112802.05 for the weekly builds
+	whole, _, _ := strings.Cut(strings.TrimSpace(info.MoodleVersion), ".")
+	version, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || version <= 0 {
+		return nil
+	}
+	var notes []string
+	for _, known := range compatibilityNotes {
+		if (known.from == 0 || version >= known.from) && (known.to == 0 || version < known.to) {
+			notes = append(notes, known.note)
+		}
+	}
+	return notes
+}
@@ -0,0 +1,82 @@
+package mfe
+
+import (
+	"io/fs"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// parsedFiles caches the files parsed from files.xml, see buildFileMapping.
+var parsedFiles xmlCache
+
+// xmlCache keeps the files parsed from the XML files of the last source, by path.
+// A new source replaces the cached entries, closing a source drops them (see forgetting),
+// and an entry is reused only if the size and modification time of its XML file did not change
+// (like a file edited in an extracted folder).
+type xmlCache struct {
+	mutex   sync.Mutex
+	source  fs.FS
+	entries map[string]xmlCacheEntry
+}
+
+// xmlCacheEntry is the result of the parsing of an XML file.
+type xmlCacheEntry struct {
+	size    int64
+	modTime time.Time
+	files   []File
+}
+
+// load returns the cached files of the XML file of the source, if any.
+// The returned slice is shared, the callers must not modify its elements.
+func (c *xmlCache) load(source fs.FS, xmlPath string) ([]File, bool) {
+	info, err := fs.Stat(source, xmlPath)
+	if err != nil || !cacheable(source) {
+		return nil, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.source != source {
+		return nil, false
+	}
+	entry, ok := c.entries[xmlPath]
+	if !ok || entry.size != info.Size() || !entry.modTime.Equal(info.ModTime()) {
+		return nil, false
+	}
+	Logger.Debug("reusing the parsed XML file", "path", xmlPath, "files", len(entry.files))
+	return entry.files, true
+}
+
+// store caches the files of the XML file of the source, replacing the entries of another source.
+func (c *xmlCache) store(source fs.FS, xmlPath string, files []File) {
+	info, err := fs.Stat(source, xmlPath)
+	if err != nil || !cacheable(source) {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.source != source {
+		c.source = source
+		c.entries = make(map[string]xmlCacheEntry)
+	}
+	c.entries[xmlPath] = xmlCacheEntry{size: info.Size(), modTime: info.ModTime(), files: files}
+}
+
+// forget drops the cached entries if they are the ones of the source.
+func (c *xmlCache) forget(source fs.FS) {
+	if !cacheable(source) {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.source == source {
+		c.source = nil
+		c.entries = nil
+	}
+}
+
+// cacheable reports whether a source can be compared to the cached one,
+// the sources of a non-comparable type (like a map) are never cached.
+func cacheable(source fs.FS) bool {
+	return source != nil && reflect.TypeOf(source).Comparable()
+}
@@ -0,0 +1,97 @@
+package mfe
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// CheckResult is the outcome of Check.
+type CheckResult struct {
+	Entries       int      // number of files read in the source
+	Files         int      // number of <file> entries of files.xml (with the folder entries and the files that are not extracted)
+	BackupXML     bool     // moodle_backup.xml is present
+	Unreadable    []string // paths of the entries of the source that cannot be read (like in a truncated archive)
+	MissingBlobs  []File   // files whose content is not in the source, sorted by ID
+	ExternalFiles int      // files of external repositories without content (not missing)
+}
+
+// Complete reports whether the backup is complete: all the entries can be read,
+// moodle_backup.xml is present and no content is missing.
+func (r CheckResult) Complete() bool {
+	return r.BackupXML && len(r.Unreadable) == 0 && len(r.MissingBlobs) == 0
+}
+
+// Check checks that the Moodle backup source is complete without copying anything:
+// it reads all the entries of the source (to detect a truncated archive),
+// and checks that files.xml, moodle_backup.xml and the content of each declared file are present.
+// Unlike Options.Verify, the content hashes are not computed.
+// An error is returned if files.xml cannot be read.
+func Check(source fs.FS) (CheckResult, error) {
+	var result CheckResult
+
+	// Read all the entries, the errors are reported but don't stop the walk
+	err := fs.WalkDir(source, ".", func(entryPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			result.Unreadable = append(result.Unreadable, entryPath)
+			Logger.Warn("unreadable entry", "path", entryPath, "error", err)
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		result.Entries++
+		if err := readAll(source, entryPath); err != nil {
+			result.Unreadable = append(result.Unreadable, entryPath)
+			Logger.Warn("unreadable entry", "path", entryPath, "error", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("error reading source: %w", err)
+	}
+
+	// The description of the backup
+	if _, err := fs.Stat(source, "moodle_backup.xml"); err == nil {
+		result.BackupXML = true
+	} else {
+		Logger.Warn("moodle_backup.xml not found")
+	}
+
+	// All the entries of files.xml, then the files with a content, including the system files and the junk files
+	files, err := parseFilesXML(source, "files.xml")
+	if err != nil {
+		return result, err
+	}
+	result.Files = len(files)
+	fileMapping, err := buildFileMapping(source, "files.xml", true, true, true)
+	if err != nil {
+		return result, err
+	}
+	for _, id := range sortedIDs(fileMapping) {
+		file := fileMapping[id]
+		if _, err := locateBlob(source, file.ContentHash); err == nil {
+			continue
+		}
+		// The content of the external files and of the empty files is not always stored
+		switch {
+		case file.isExternal():
+			result.ExternalFiles++
+		case file.isEmpty():
+		default:
+			result.MissingBlobs = append(result.MissingBlobs, file)
+		}
+	}
+	return result, nil
+}
+
+// readAll reads the whole content of an entry of the source.
+func readAll(source fs.FS, entryPath string) error {
+	file, err := source.Open(entryPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(io.Discard, file)
+	return err
+}
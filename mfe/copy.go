@@ -0,0 +1,962 @@
+package mfe
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// copyFiles copies files from the source to the destination folder based on the file mapping.
+// the file with hash xyz... is in files/xy/xyz...
+// The destinations are resolved one file at a time in the order of the file IDs, so that the
+// collision policy gives the same result on every run, then the files are copied by a pool
+// of opts.Jobs goroutines.
+// In dry-run mode nothing is written, but the files that would be created are reported and counted.
+// It returns the number of copied files and the joined errors of the files that failed to copy
+// (skipped and missing files are not errors).
+// If the context is canceled, the remaining files are not copied and the context error is returned.
+func copyFiles(ctx context.Context, source fs.FS, destinationFolder string, fileMapping map[string]File, opts Options) (Stats, error) {
+	// Number of copied, skipped, missing and failed files
+	var stats Stats
+	// Errors of the failed copies
+	var errs []error
+	var mutex sync.Mutex
+	// Shared state of the workers
+	c := &copier{
+		Options:           opts,
+		ctx:               ctx,
+		source:            source,
+		destinationFolder: destinationFolder,
+		session:           cmp.Or(opts.Session, &Session{}),
+	}
+	c.session.init()
+
+	// Count the declared size of all the files, the bytes of the files that are not copied are done at once
+	c.progress = &progress{report: opts.Progress}
+	for _, file := range fileMapping {
+		c.progress.total += max(file.Filesize, 0)
+	}
+
+	// Count the outcome of the copy of a file
+	record := func(file File, result copyResult) {
+		if result.Status != statusCopied {
+			c.progress.add(max(file.Filesize, 0))
+		}
+		mutex.Lock()
+		stats.add(file, result)
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+		}
+		mutex.Unlock()
+		opts.Manifest.add(file, result)
+	}
+
+	// Detect the layout of the files folder
+	logBlobLayout(source)
+
+	// Create the archive that receives the files instead of the destination folder
+	if c.toArchive() && !opts.DryRun {
+		archive, err := newArchiveWriter(destinationFolder, opts.OutputFormat)
+		if err != nil {
+			return stats, err
+		}
+		c.archive = archive
+	}
+	// Create the destination folder, even if no file is copied, and abort at once if it is not writable
+	if !c.toArchive() && !opts.DryRun {
+		if err := os.MkdirAll(destinationFolder, os.ModePerm); err != nil {
+			return stats, withHint(fmt.Errorf("error creating directory %s: %w", destinationFolder, err))
+		}
+		if err := checkWritable(destinationFolder); err != nil {
+			return stats, err
+		}
+	}
+
+	// Start the workers
+	jobs := max(opts.Jobs, 1)
+	tasks := make(chan copyTask)
+	var wg sync.WaitGroup
+	for range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range tasks {
+				// Drain the remaining files once canceled
+				if ctx.Err() != nil {
+					continue
+				}
+				record(task.file, c.writeFile(task))
+			}
+		}()
+	}
+
+	// Resolve the destination of each file in the Moodle order, and send the files to write to the workers
+	for _, id := range orderedIDs(fileMapping) {
+		if ctx.Err() != nil {
+			break
+		}
+		file := fileMapping[id]
+		sourcePath, result, ok := c.planFile(file)
+		if !ok {
+			record(file, result)
+			continue
+		}
+		tasks <- copyTask{file: file, sourcePath: sourcePath, result: result}
+	}
+	close(tasks)
+	wg.Wait()
+
+	// Finish the archive
+	if c.archive != nil {
+		if err := c.archive.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("error closing archive %s: %w", destinationFolder, err))
+		}
+	}
+
+	// The files are copied concurrently, sort the failures
+	sort.Strings(stats.FailedIDs)
+
+	// Abort if canceled
+	if err := ctx.Err(); err != nil {
+		return stats, err
+	}
+	return stats, errors.Join(errs...)
+}
+
+// sortedIDs returns the IDs of the file mapping in increasing order.
+func sortedIDs(fileMapping map[string]File) []string {
+	ids := make([]string, 0, len(fileMapping))
+	for id := range fileMapping {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// orderedIDs returns the IDs of the file mapping in the order of Moodle:
+// by folder, then by sortorder in the folder, then by filename (and ID for the same filename).
+// This is the order of the numbered renames on collision.
+func orderedIDs(fileMapping map[string]File) []string {
+	ids := sortedIDs(fileMapping)
+	slices.SortStableFunc(ids, func(a, b string) int {
+		return compareFiles(fileMapping[a], fileMapping[b])
+	})
+	return ids
+}
+
+// compareFiles compares two files by folder, then by sortorder and filename.
+func compareFiles(a, b File) int {
+	return cmp.Or(
+		strings.Compare(path.Join(a.Section, a.Folder, sanitizeFilepath(a.Filepath)), path.Join(b.Section, b.Folder, sanitizeFilepath(b.Filepath))),
+		cmp.Compare(a.Sortorder, b.Sortorder),
+		strings.Compare(a.Filename, b.Filename),
+	)
+}
+
+// locateBlob returns the path of the file with the given content hash in the source.
+// The file with hash xyz... is usually in files/xy/xyz..., but some older backups store it
+// directly in files/xyz..., so this layout is used as a fallback.
+// The hash is validated by buildFileMapping.
+func locateBlob(source fs.FS, hash string) (string, error) {
+	shardedPath := path.Join("files", hash[:2], hash)
+	if _, err := fs.Stat(source, shardedPath); err == nil {
+		return shardedPath, nil
+	}
+	flatPath := path.Join("files", hash)
+	if _, err := fs.Stat(source, flatPath); err == nil {
+		return flatPath, nil
+	}
+	return "", fmt.Errorf("file %s not found in source folder", shardedPath)
+}
+
+// logBlobLayout logs the layout of the files folder: sharded (files/xy/xyz...) or flat (files/xyz...).
+func logBlobLayout(source fs.FS) {
+	entries, err := fs.ReadDir(source, "files")
+	if err != nil {
+		Logger.Warn("error reading files folder", "error", err)
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			Logger.Debug("files layout", "layout", "sharded")
+			return
+		}
+	}
+	if len(entries) > 0 {
+		Logger.Info("files layout", "layout", "flat")
+	}
+}
+
+// Stats counts the files by outcome of the copy.
+type Stats struct {
+	Copied  int // copied files (or that would be copied in dry-run mode)
+	Skipped int // skipped files (already existing or filtered out)
+	Missing int // files not found in the source
+	Failed  int // files that failed to copy
+	Empty   int // skipped empty files (counted in Skipped)
+	Old     int // skipped files modified before Since (counted in Skipped)
+	// Duplicates counts the skipped files whose content was already copied with UniqueContent (counted in Skipped)
+	Duplicates int
+	Bytes      int64 // bytes of the copied files
+	// Folders counts the copied files by folder (with the section if any), "" for the top folder
+	Folders map[string]int
+	// FailedIDs are the IDs of the files that failed to copy, sorted, to retry them with Options.OnlyIDs
+	FailedIDs []string
+}
+
+// add counts the outcome of the copy of a file.
+func (s *Stats) add(file File, result copyResult) {
+	switch {
+	case result.copied():
+		s.Copied++
+		if s.Folders == nil {
+			s.Folders = make(map[string]int)
+		}
+		s.Folders[path.Join(file.Section, file.Folder)]++
+		s.Bytes += result.Size
+	case result.Status == statusMissing:
+		s.Missing++
+	case result.Status == statusFailed:
+		s.Failed++
+		s.FailedIDs = append(s.FailedIDs, file.ID)
+	case result.Status == statusEmpty:
+		s.Skipped++
+		s.Empty++
+	case result.Status == statusOld:
+		s.Skipped++
+		s.Old++
+	case result.Status == statusDuplicate:
+		s.Skipped++
+		s.Duplicates++
+	default:
+		s.Skipped++
+	}
+}
+
+// contextReader is a reader that stops reading when the context is canceled.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(p)
+}
+
+// progress counts the bytes of the copied files and reports them to Options.Progress.
+// It is an io.Writer that counts the bytes written to it, it is safe for concurrent use.
+type progress struct {
+	done   atomic.Int64
+	total  int64
+	report func(done, total int64)
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.add(int64(len(b)))
+	return len(b), nil
+}
+
+// add counts n more bytes done and reports the progress.
+func (p *progress) add(n int64) {
+	done := p.done.Add(n)
+	if p.report != nil {
+		p.report(done, p.total)
+	}
+}
+
+// attemptProgress counts the bytes of a single copy attempt on top of the progress,
+// so that they can be removed from the progress if the attempt fails.
+type attemptProgress struct {
+	progress *progress
+	counted  int64
+}
+
+func (a *attemptProgress) Write(b []byte) (int, error) {
+	a.counted += int64(len(b))
+	return a.progress.Write(b)
+}
+
+// copier holds the state shared by the copyFiles workers.
+type copier struct {
+	Options
+	ctx               context.Context
+	source            fs.FS
+	destinationFolder string
+	// session holds the written paths, the claimed paths and the planned contents (see Session)
+	session *Session
+	// createdDirs contains the directories already created (or planned in dry-run mode)
+	createdDirs sync.Map
+	// progress counts the bytes of the copied files
+	progress *progress
+	// archive receives the files if the output format is tar or zip
+	archive *archiveWriter
+}
+
+// Session is the state shared by the extractions to the same destination (like the sources merged by the command),
+// so that a file is hardlinked (with Dedup) to the same content written by a previous extraction,
+// a path written by a previous extraction is never overwritten, and UniqueContent spans all the extractions.
+// The zero value is ready to use, and the extractions sharing a session must not run concurrently.
+type Session struct {
+	// writtenPaths maps a content hash to the first path written with this content
+	writtenPaths      map[string]string
+	writtenPathsMutex sync.Mutex
+	// claimedPaths contains the destination paths already taken by a file, by their claimKey
+	// (only used by copyFiles before sending the files to the workers)
+	claimedPaths map[string]bool
+	// plannedContent contains the content hashes already planned with UniqueContent
+	// (only used by copyFiles before sending the files to the workers)
+	plannedContent map[string]bool
+}
+
+// init creates the maps of a new session.
+func (s *Session) init() {
+	if s.writtenPaths == nil {
+		s.writtenPaths = make(map[string]string)
+		s.claimedPaths = make(map[string]bool)
+		s.plannedContent = make(map[string]bool)
+	}
+}
+
+// collisionPolicy returns the collision policy, by default skip, or rename in flat mode.
+func (c *copier) collisionPolicy() string {
+	if c.OnCollision != "" {
+		return c.OnCollision
+	}
+	if c.Flat {
+		return "rename"
+	}
+	return "skip"
+}
+
+// claimKey returns the key of a destination path in claimedPaths:
+// the lowercased path with CaseInsensitive, so that Foo.pdf and foo.pdf collide.
+func (c *copier) claimKey(destinationPath string) string {
+	if c.CaseInsensitive {
+		return strings.ToLower(destinationPath)
+	}
+	return destinationPath
+}
+
+// toArchive reports if the files are written to a tar or zip archive instead of the destination folder.
+func (opts Options) toArchive() bool {
+	return opts.OutputFormat == "tar" || opts.OutputFormat == "zip"
+}
+
+// CollisionPolicies lists the supported values of the --on-collision flag.
+var CollisionPolicies = []string{"skip", "rename", "overwrite", "newer"}
+
+// fileExists reports if a file exists on disk, and an error if this cannot be checked.
+func fileExists(filePath string) (bool, error) {
+	_, err := os.Stat(filePath)
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// isNewer reports if the file was modified in the backup after the file at filePath.
+// A file without modification time in the backup is never newer.
+func isNewer(file File, filePath string) (bool, error) {
+	mtime, ok := file.modificationTime()
+	if !ok {
+		return false, nil
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return false, fmt.Errorf("checking file %s: %w", filePath, err)
+	}
+	return mtime.After(info.ModTime()), nil
+}
+
+// resolveDestination applies the collision policy to a destination path and claims the resulting path.
+// It returns the path to write to and false if the file must be skipped,
+// or an error if the existence of a path cannot be checked.
+// A path is taken if it exists on disk or was already claimed by another file in this run
+// (ignoring the case with CaseInsensitive).
+//   - skip: a taken path is skipped
+//   - rename: " (2)", " (3)", ... is appended before the extension until a free path is found
+//     (the renamed name is truncated to MaxNameLen like the original one, see truncateName)
+//   - overwrite: an existing file on disk is overwritten (but not a file written in this run)
+//   - newer: an existing file on disk is overwritten only if the file was modified after it in the backup
+func (c *copier) resolveDestination(destinationPath string, policy string, file File) (string, bool, error) {
+	ext := filepath.Ext(destinationPath)
+	base := strings.TrimSuffix(destinationPath, ext)
+	candidate := destinationPath
+	for n := 2; ; n++ {
+		// The entries of an archive are only taken by the files of this run
+		exists := false
+		if !c.toArchive() {
+			var err error
+			exists, err = fileExists(candidate)
+			if err != nil {
+				return "", false, fmt.Errorf("checking file %s: %w", candidate, err)
+			}
+		}
+		switch {
+		case c.session.claimedPaths[c.claimKey(candidate)]:
+			if policy != "rename" {
+				logVerbose("skipped", "reason", "exists", "dest", candidate)
+				return "", false, nil
+			}
+		case exists && policy == "skip":
+			logVerbose("skipped", "reason", "exists", "dest", candidate)
+			return "", false, nil
+		case exists && policy == "overwrite":
+			logVerbose("overwrite", "dest", candidate)
+			c.session.claimedPaths[c.claimKey(candidate)] = true
+			return candidate, true, nil
+		case exists && policy == "newer":
+			newer, err := isNewer(file, candidate)
+			if err != nil {
+				return "", false, err
+			}
+			if !newer {
+				logVerbose("skipped", "reason", "not newer", "dest", candidate)
+				return "", false, nil
+			}
+			logVerbose("overwrite", "reason", "newer", "dest", candidate)
+			c.session.claimedPaths[c.claimKey(candidate)] = true
+			return candidate, true, nil
+		case !exists:
+			c.session.claimedPaths[c.claimKey(candidate)] = true
+			return candidate, true, nil
+		}
+		// Try the next name
+		candidate = filepath.Join(filepath.Dir(base), truncateName(fmt.Sprintf("%s (%d)%s", filepath.Base(base), n, ext), c.maxNameLen()))
+	}
+}
+
+// Status of a file after copyFiles
+const (
+	statusCopied    = "copied"
+	statusLinked    = "linked"
+	statusPlanned   = "planned" // would be copied in dry-run mode
+	statusSkipped   = "skipped"
+	statusExcluded  = "excluded"  // filtered out by --include or --exclude
+	statusEmpty     = "empty"     // skipped empty file with --exclude-empty
+	statusOld       = "old"       // skipped file modified before --since
+	statusDuplicate = "duplicate" // skipped file whose content was already copied with --unique-content
+	statusExternal  = "external"  // skipped file of an external repository, without content
+	statusShortcut  = "shortcut"  // shortcut written for a file of an external repository
+	statusMissing   = "missing"
+	statusFailed    = "failed"
+)
+
+// copyResult is the outcome of the copy of a single file.
+type copyResult struct {
+	Status      string
+	Destination string
+	Size        int64
+	Err         error // why the copy failed
+}
+
+// fail reports the error of a failed copy and returns the failed result.
+func (r copyResult) fail(err error) copyResult {
+	err = withHint(err)
+	Logger.Error("copy failed", "dest", r.Destination, "error", err)
+	r.Status = statusFailed
+	r.Err = err
+	return r
+}
+
+// copied reports if the file was (or would be in dry-run mode) written to its destination.
+func (r copyResult) copied() bool {
+	return r.Status == statusCopied || r.Status == statusLinked || r.Status == statusPlanned || r.Status == statusShortcut
+}
+
+// matchFilters reports if a filename passes the include and exclude glob patterns.
+// Exclude wins over include, and when include patterns are given, only matching names pass.
+func matchFilters(name string, include []string, exclude []string) bool {
+	for _, pattern := range exclude {
+		if matched, _ := path.Match(pattern, name); matched {
+			return false
+		}
+	}
+	if len(include) == 0 {
+		return true
+	}
+	for _, pattern := range include {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// emptyContentHash is the content hash (SHA-1) of the empty files.
+const emptyContentHash = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+
+// isEmpty reports whether the file is empty: its declared size is 0, or it has the content hash of the empty content.
+// A file of unknown size is not empty, unless its content hash says so.
+func (f File) isEmpty() bool {
+	return f.Filesize == 0 || f.ContentHash == emptyContentHash
+}
+
+// matchSize reports whether a file of the given size is within the --min-size and --max-size limits.
+// A file of unknown size is not filtered out.
+func (opts Options) matchSize(size int64) bool {
+	return size == unknownSize || size >= opts.MinSize && (opts.MaxSize == 0 || size <= opts.MaxSize)
+}
+
+// matchSince reports whether the file was modified at or after Since, or has no modification time.
+func (opts Options) matchSince(file File) bool {
+	mtime, ok := file.modificationTime()
+	return opts.Since.IsZero() || !ok || !mtime.Before(opts.Since)
+}
+
+// CheckDestination returns an error if the destination exists but is a file instead of a folder,
+// or a folder instead of an archive file with a tar or zip output format.
+// Extract checks it too, it is exported to check the destination before doing anything to it.
+func (opts Options) CheckDestination(destination string) error {
+	info, err := os.Stat(destination)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error checking destination %s: %w", destination, err)
+	}
+	if opts.toArchive() && info.IsDir() {
+		return fmt.Errorf("destination %s is a folder, not a %s file", destination, opts.OutputFormat)
+	}
+	if !opts.toArchive() && !info.IsDir() {
+		return fmt.Errorf("destination %s is a file, not a folder", destination)
+	}
+	return nil
+}
+
+// checkWritable checks that a file can be created in the folder, to abort before copying
+// when the destination is read-only (like a read-only mount) or not writable by the user.
+func checkWritable(folder string) error {
+	probe, err := os.CreateTemp(folder, ".mfe-write-test-*")
+	if err != nil {
+		return withHint(fmt.Errorf("cannot write to %s: %w", folder, err))
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// withHint adds an advice to the permission and read-only filesystem errors, that are not about a single file.
+func withHint(err error) error {
+	switch {
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("%w (check the permissions of the file and of its folder)", err)
+	case errors.Is(err, syscall.EROFS):
+		return fmt.Errorf("%w (the filesystem is mounted read-only)", err)
+	}
+	return err
+}
+
+// isWithin reports if the target path is inside the base folder.
+func isWithin(base string, target string) bool {
+	relativePath, err := filepath.Rel(base, target)
+	if err != nil {
+		return false
+	}
+	return relativePath != ".." && !strings.HasPrefix(relativePath, ".."+string(filepath.Separator))
+}
+
+// destinationPath returns the path where the file is copied.
+func (c *copier) destinationPath(file File) string {
+	return filepath.Join(c.destinationFolder, filepath.FromSlash(relativePath(file, c.Options)))
+}
+
+// copyTask is a file to write by the copyFiles workers.
+type copyTask struct {
+	file       File
+	sourcePath string     // path of the content of the file in the source
+	result     copyResult // destination and size of the file
+}
+
+// planFile resolves the destination of a single file and claims it.
+// It returns the path of the content of the file in the source, and the destination and size
+// of the file in the result, or false if the file must not be written with the outcome in the result.
+// In dry-run mode the file is only reported and never written.
+func (c *copier) planFile(file File) (string, copyResult, bool) {
+	// Construct the destination path
+	destinationPath := c.destinationPath(file)
+	// Never write outside of the destination folder (path traversal from a crafted backup)
+	if !isWithin(c.destinationFolder, destinationPath) {
+		Logger.Warn("skipped unsafe path", "id", file.ID, "dest", destinationPath, "outside", c.destinationFolder)
+		return "", copyResult{Status: statusSkipped}, false
+	}
+
+	// Skip the files filtered out by --include and --exclude
+	if !matchFilters(file.Filename, c.Include, c.Exclude) {
+		Logger.Debug("skipped", "reason", "filtered", "id", file.ID, "dest", destinationPath)
+		return "", copyResult{Status: statusExcluded, Destination: destinationPath}, false
+	}
+	// Skip the files filtered out by --min-size and --max-size
+	if !c.matchSize(file.Filesize) {
+		Logger.Debug("skipped", "reason", "size", "id", file.ID, "size", file.Filesize, "dest", destinationPath)
+		return "", copyResult{Status: statusExcluded, Destination: destinationPath}, false
+	}
+	// Skip the empty files with --exclude-empty
+	if c.ExcludeEmpty && file.isEmpty() {
+		Logger.Debug("skipped", "reason", "empty", "id", file.ID, "dest", destinationPath)
+		return "", copyResult{Status: statusEmpty, Destination: destinationPath}, false
+	}
+
+	// Skip the files modified before --since (the files without modification time are copied)
+	if !c.matchSince(file) {
+		Logger.Debug("skipped", "reason", "old", "id", file.ID, "modified", file.Timemodified, "dest", destinationPath)
+		return "", copyResult{Status: statusOld, Destination: destinationPath}, false
+	}
+
+	// Find the file in the source FS
+	sourceFilePath, err := locateBlob(c.source, file.ContentHash)
+	if err != nil {
+		// The files of the external repositories are usually not in the backup
+		if file.isExternal() {
+			return "", c.planExternal(file, destinationPath), false
+		}
+		Logger.Warn("missing file", "id", file.ID, "hash", file.ContentHash, "error", err)
+		return "", copyResult{Status: statusMissing, Destination: destinationPath}, false
+	}
+	// Skip the content already planned with --unique-content, the first file in the Moodle order wins
+	if c.UniqueContent {
+		if c.session.plannedContent[file.ContentHash] {
+			logVerbose("skipped", "reason", "duplicate content", "id", file.ID, "hash", file.ContentHash, "dest", destinationPath)
+			return "", copyResult{Status: statusDuplicate, Destination: destinationPath}, false
+		}
+		c.session.plannedContent[file.ContentHash] = true
+	}
+	result := copyResult{Status: statusFailed, Destination: destinationPath}
+	if info, err := fs.Stat(c.source, sourceFilePath); err == nil {
+		result.Size = info.Size()
+	}
+
+	// Apply the collision policy if the destination file already exists
+	destinationPath, ok, err := c.resolveDestination(destinationPath, c.collisionPolicy(), file)
+	if err != nil {
+		return "", result.fail(err), false
+	}
+	if !ok {
+		result.Status = statusSkipped
+		return "", result, false
+	}
+	result.Destination = destinationPath
+
+	// In dry-run mode only report what would be created
+	if c.DryRun {
+		destinationDir := filepath.Dir(destinationPath)
+		if _, err := os.Stat(destinationDir); os.IsNotExist(err) && !c.toArchive() {
+			if _, planned := c.createdDirs.LoadOrStore(destinationDir, true); !planned {
+				logVerbose("created folder", "dest", destinationDir)
+			}
+		}
+		logVerbose("planned", "id", file.ID, "dest", destinationPath)
+		result.Status = statusPlanned
+		return "", result, false
+	}
+
+	return sourceFilePath, result, true
+}
+
+// writeFile copies a single file to the destination resolved by planFile and returns the outcome.
+func (c *copier) writeFile(task copyTask) copyResult {
+	file, sourceFilePath, result := task.file, task.sourcePath, task.result
+	destinationPath := result.Destination
+	destinationDir := filepath.Dir(destinationPath)
+
+	// Open the file from the source FS
+	sourceFile, err := c.source.Open(sourceFilePath)
+	if errors.Is(err, fs.ErrPermission) {
+		return result.fail(fmt.Errorf("cannot read %s: %w", sourceFilePath, err))
+	}
+	if err != nil {
+		Logger.Warn("missing file", "id", file.ID, "hash", file.ContentHash, "error", err)
+		result.Status = statusMissing
+		return result
+	}
+	defer sourceFile.Close()
+
+	// Add the file to the archive instead of the destination folder
+	if c.archive != nil {
+		return c.addToArchive(file, sourceFile, result)
+	}
+
+	// Ensure the destination directory exists
+	if _, err := os.Stat(destinationDir); os.IsNotExist(err) {
+		// Create the directory if it doesn't exist
+		if err := os.MkdirAll(destinationDir, os.ModePerm); err != nil {
+			return result.fail(fmt.Errorf("creating directory %s: %w", destinationDir, err))
+		}
+		if _, created := c.createdDirs.LoadOrStore(destinationDir, true); !created {
+			logVerbose("created folder", "dest", destinationDir)
+		}
+	} else if err != nil {
+		return result.fail(fmt.Errorf("checking directory %s: %w", destinationDir, err))
+	}
+
+	// Hardlink to an already written file with the same content, fall back to a copy on failure
+	if c.Dedup == "hardlink" {
+		c.session.writtenPathsMutex.Lock()
+		firstPath, written := c.session.writtenPaths[file.ContentHash]
+		c.session.writtenPathsMutex.Unlock()
+		if written {
+			err := os.Link(firstPath, destinationPath)
+			if err == nil {
+				logVerbose("linked", "id", file.ID, "hash", file.ContentHash, "dest", destinationPath, "target", firstPath)
+				c.writeSidecar(file, destinationPath)
+				result.Status = statusLinked
+				return result
+			}
+			Logger.Debug("hardlink failed, copy instead", "dest", destinationPath, "error", err)
+		}
+	}
+
+	// Copy the file content, retrying with an exponential backoff on failure
+	written, err := c.copyContent(file, sourceFile, destinationPath)
+	for attempt := 1; err != nil && attempt <= c.Retries && c.ctx.Err() == nil; attempt++ {
+		delay := retryDelay << (attempt - 1)
+		Logger.Warn("copy failed, retrying", "dest", destinationPath, "attempt", attempt, "delay", delay, "error", err)
+		select {
+		case <-c.ctx.Done():
+		case <-time.After(delay):
+			written, err = c.reopenAndCopy(file, sourceFilePath, destinationPath)
+		}
+	}
+	if err != nil {
+		return result.fail(err)
+	}
+	result.Size = written
+	// A size different from the declared one is a sign of a corrupt archive
+	if file.Filesize != unknownSize && written != file.Filesize {
+		Logger.Warn("size mismatch", "id", file.ID, "dest", destinationPath, "size", written, "declared", file.Filesize)
+	}
+
+	// Set the modification time of the file from the backup
+	if c.PreserveTimes {
+		if mtime, ok := file.modificationTime(); ok {
+			if err := os.Chtimes(destinationPath, time.Time{}, mtime); err != nil {
+				Logger.Warn("error setting the modification time", "dest", destinationPath, "error", err)
+			}
+		}
+	}
+
+	// Remember the first path written with this content
+	if c.Dedup == "hardlink" {
+		c.session.writtenPathsMutex.Lock()
+		if _, written := c.session.writtenPaths[file.ContentHash]; !written {
+			c.session.writtenPaths[file.ContentHash] = destinationPath
+		}
+		c.session.writtenPathsMutex.Unlock()
+	}
+
+	logVerbose("copied", "id", file.ID, "hash", file.ContentHash, "folder", file.Folder, "dest", destinationPath, "size", result.Size)
+	c.writeSidecar(file, destinationPath)
+	result.Status = statusCopied
+	return result
+}
+
+// retryDelay is the delay before the first retry of a failed copy, it doubles at each retry.
+const retryDelay = 500 * time.Millisecond
+
+// copyContent copies the content of the source file to the destination path and returns the number of bytes written.
+// On failure the partially written destination file is removed, so that the copy can be retried.
+func (c *copier) copyContent(file File, sourceFile io.Reader, destinationPath string) (int64, error) {
+	// Create the destination file
+	destinationFile, err := c.createFile(destinationPath)
+	if err != nil {
+		return 0, fmt.Errorf("creating file %s: %w", destinationPath, err)
+	}
+	defer destinationFile.Close()
+	// The bytes of a failed attempt are not done, they are removed from the progress
+	attempt := &attemptProgress{progress: c.progress}
+	fail := func(err error) (int64, error) {
+		destinationFile.Close()
+		os.Remove(destinationPath)
+		c.progress.add(-attempt.counted)
+		return 0, err
+	}
+
+	// Copy the file content, hashing it on the fly if it must be verified
+	var reader io.Reader = io.TeeReader(contextReader{ctx: c.ctx, reader: sourceFile}, attempt)
+	hash := sha1.New()
+	if c.Verify {
+		reader = io.TeeReader(reader, hash)
+	}
+	written, err := io.Copy(destinationFile, reader)
+	if err != nil {
+		return fail(fmt.Errorf("copying file %s to %s: %w", file.ContentHash, destinationPath, err))
+	}
+
+	// The content hash is the SHA-1 of the content, remove the copy if they don't match
+	if c.Verify {
+		if sum := hex.EncodeToString(hash.Sum(nil)); sum != file.ContentHash {
+			return fail(fmt.Errorf("verifying file %s: SHA-1 %s does not match content hash %s", destinationPath, sum, file.ContentHash))
+		}
+	}
+
+	// Close the file before setting its modification time
+	if err := destinationFile.Close(); err != nil {
+		return fail(fmt.Errorf("closing file %s: %w", destinationPath, err))
+	}
+	return written, nil
+}
+
+// createFile creates the destination file. With the overwrite and newer policies, an existing file is removed
+// rather than truncated: it may be a hardlink (see Dedup) and its other links must keep their content.
+// In safe mode the file is created exclusively (O_EXCL), so that two extractions to the same destination
+// don't write to the same file: the creation fails if another extraction created the file since it was planned.
+func (c *copier) createFile(destinationPath string) (*os.File, error) {
+	if policy := c.collisionPolicy(); policy == "overwrite" || policy == "newer" {
+		if err := os.Remove(destinationPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	if !c.Safe {
+		return os.Create(destinationPath)
+	}
+	file, err := os.OpenFile(destinationPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o666)
+	if errors.Is(err, fs.ErrExist) {
+		return nil, fmt.Errorf("%w (created by another extraction?)", err)
+	}
+	return file, err
+}
+
+// reopenAndCopy opens the source file again and copies its content to the destination path (see copyContent).
+func (c *copier) reopenAndCopy(file File, sourceFilePath string, destinationPath string) (int64, error) {
+	sourceFile, err := c.source.Open(sourceFilePath)
+	if err != nil {
+		return 0, fmt.Errorf("opening file %s: %w", sourceFilePath, err)
+	}
+	defer sourceFile.Close()
+	return c.copyContent(file, sourceFile, destinationPath)
+}
+
+// sidecarSuffix is appended to the path of a copied file to get the path of its sidecar file.
+const sidecarSuffix = ".mfe.json"
+
+// sidecar is the Moodle metadata of a copied file, written next to it with --sidecar.
+type sidecar struct {
+	ID               string `json:"id"`
+	ContentHash      string `json:"contenthash"`
+	OriginalFilename string `json:"original_filename"`
+	Filepath         string `json:"filepath"`
+	Component        string `json:"component"`
+	Filearea         string `json:"filearea"`
+	Author           string `json:"author"`
+	License          string `json:"license"`
+	Timecreated      string `json:"timecreated"`
+	Timemodified     string `json:"timemodified"`
+}
+
+// writeSidecar writes the sidecar file of a copied file if Sidecar is set.
+// A sidecar that cannot be written is reported, but the copy is not failed.
+func (c *copier) writeSidecar(file File, destinationPath string) {
+	if !c.Sidecar {
+		return
+	}
+	data, err := json.MarshalIndent(sidecar{
+		ID:               file.ID,
+		ContentHash:      file.ContentHash,
+		OriginalFilename: file.OriginalFilename,
+		Filepath:         file.Filepath,
+		Component:        file.Component,
+		Filearea:         file.Filearea,
+		Author:           file.Author,
+		License:          file.License,
+		Timecreated:      file.Timecreated,
+		Timemodified:     file.Timemodified,
+	}, "", "  ")
+	data = append(data, '\n')
+	if err == nil && c.archive != nil {
+		_, err = c.archive.add(destinationPath+sidecarSuffix, int64(len(data)), time.Now(), bytes.NewReader(data))
+	} else if err == nil {
+		err = os.WriteFile(destinationPath+sidecarSuffix, data, 0o644)
+	}
+	if err != nil {
+		Logger.Warn("error writing the sidecar file", "dest", destinationPath+sidecarSuffix, "error", err)
+	}
+}
+
+// ManifestEntry describes a file of the backup in the JSON manifest.
+type ManifestEntry struct {
+	ID               string `json:"id"`
+	ContentHash      string `json:"contenthash"`
+	OriginalFilename string `json:"original_filename"`
+	Filename         string `json:"filename"`
+	Folder           string `json:"folder"`
+	Sortorder        int    `json:"sortorder"`
+	Destination      string `json:"destination"`
+	Size             int64  `json:"size"`
+	Status           string `json:"status"`
+}
+
+// Manifest collects the manifest entries of the copied (or skipped) files.
+// A nil manifest ignores the entries.
+type Manifest struct {
+	mutex   sync.Mutex
+	entries []ManifestEntry
+}
+
+// add adds a file and the outcome of its copy to the manifest, it is safe for concurrent use.
+func (m *Manifest) add(file File, result copyResult) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.entries = append(m.entries, ManifestEntry{
+		ID:               file.ID,
+		ContentHash:      file.ContentHash,
+		OriginalFilename: file.OriginalFilename,
+		Filename:         file.Filename,
+		Folder:           path.Join(file.Section, file.Folder),
+		Sortorder:        file.Sortorder,
+		Destination:      result.Destination,
+		Size:             result.Size,
+		Status:           result.Status,
+	})
+}
+
+// Write writes the manifest as a JSON array to the given file.
+func (m *Manifest) Write(manifestPath string) error {
+	// Sort the entries in the Moodle order, to have a stable manifest between runs
+	slices.SortFunc(m.entries, func(a, b ManifestEntry) int {
+		return cmp.Or(
+			strings.Compare(filepath.Dir(a.Destination), filepath.Dir(b.Destination)),
+			cmp.Compare(a.Sortorder, b.Sortorder),
+			strings.Compare(a.Filename, b.Filename),
+			strings.Compare(a.ID, b.ID),
+		)
+	})
+
+	// Always write an array, even if there are no entries
+	entries := m.entries
+	if entries == nil {
+		entries = []ManifestEntry{}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding manifest: %w", err)
+	}
+	if err := os.WriteFile(manifestPath, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+	return nil
+}
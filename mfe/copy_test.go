@@ -0,0 +1,362 @@
+package mfe
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// newTestCopier returns a copier to the destination folder, with the state set by copyFiles.
+func newTestCopier(opts Options, destination string) *copier {
+	c := &copier{
+		Options:           opts,
+		ctx:               context.Background(),
+		destinationFolder: destination,
+		session:           &Session{},
+		progress:          &progress{},
+	}
+	c.session.init()
+	return c
+}
+
+// writeFile writes a file with the given content and modification time.
+func writeFile(t *testing.T, filePath string, content string, mtime time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filePath, time.Time{}, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveDestination(t *testing.T) {
+	existingTime := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	older := File{ID: "1", Timemodified: strconv.FormatInt(existingTime.Add(-time.Hour).Unix(), 10)}
+	newer := File{ID: "1", Timemodified: strconv.FormatInt(existingTime.Add(time.Hour).Unix(), 10)}
+	tests := []struct {
+		policy string
+		file   File
+		target string // a.pdf exists, b.pdf does not
+		want   string // the resolved name, or empty if skipped
+	}{
+		{"skip", older, "a.pdf", ""},
+		{"skip", older, "b.pdf", "b.pdf"},
+		{"rename", older, "a.pdf", "a (3).pdf"}, // a (2).pdf exists too
+		{"rename", older, "b.pdf", "b.pdf"},
+		{"overwrite", older, "a.pdf", "a.pdf"},
+		{"overwrite", older, "b.pdf", "b.pdf"},
+		{"newer", older, "a.pdf", ""},
+		{"newer", newer, "a.pdf", "a.pdf"},
+		{"newer", File{ID: "1"}, "a.pdf", ""}, // without modification time
+		{"newer", older, "b.pdf", "b.pdf"},
+	}
+	for _, test := range tests {
+		t.Run(test.policy+"/"+test.target, func(t *testing.T) {
+			destination := t.TempDir()
+			writeFile(t, filepath.Join(destination, "a.pdf"), "existing", existingTime)
+			writeFile(t, filepath.Join(destination, "a (2).pdf"), "existing", existingTime)
+			c := newTestCopier(Options{OnCollision: test.policy}, destination)
+
+			got, ok, err := c.resolveDestination(filepath.Join(destination, test.target), test.policy, test.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.want == "" {
+				if ok {
+					t.Errorf("got %s, want skipped", got)
+				}
+				return
+			}
+			if !ok || got != filepath.Join(destination, test.want) {
+				t.Errorf("got %s (%v), want %s", got, ok, test.want)
+			}
+			if !c.session.claimedPaths[got] {
+				t.Errorf("%s is not claimed", got)
+			}
+		})
+	}
+}
+
+func TestResolveDestinationClaimed(t *testing.T) {
+	// a path written in this run is never overwritten, only renamed
+	for policy, want := range map[string]string{"skip": "", "overwrite": "", "newer": "", "rename": "a (2).pdf"} {
+		t.Run(policy, func(t *testing.T) {
+			destination := t.TempDir()
+			c := newTestCopier(Options{}, destination)
+			target := filepath.Join(destination, "a.pdf")
+			if _, ok, err := c.resolveDestination(target, policy, File{ID: "1"}); err != nil || !ok {
+				t.Fatalf("first claim failed: %v", err)
+			}
+
+			got, ok, err := c.resolveDestination(target, policy, File{ID: "2"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want == "" && ok {
+				t.Errorf("got %s, want skipped", got)
+			}
+			if want != "" && (!ok || got != filepath.Join(destination, want)) {
+				t.Errorf("got %s (%v), want %s", got, ok, want)
+			}
+		})
+	}
+}
+
+func TestCopyFilesOverwrite(t *testing.T) {
+	destination := t.TempDir()
+	// a longer existing content is truncated
+	writeFile(t, filepath.Join(destination, "Lecture notes", "a.pdf"), "a longer existing content", time.Now())
+
+	result, err := Extract(context.Background(), courseBackup(), destination, Options{OnCollision: "overwrite"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Copied != 6 {
+		t.Errorf("copied %d files, want 6", result.Copied)
+	}
+	if content, err := os.ReadFile(filepath.Join(destination, "Lecture notes", "a.pdf")); err != nil || string(content) != "first" {
+		t.Errorf("got content %q (%v), want \"first\"", content, err)
+	}
+}
+
+func TestMatchFilters(t *testing.T) {
+	include := []string{"*.pdf", "lecture*"}
+	exclude := []string{"*.mp4"}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"notes.pdf", true},
+		{"lecture.txt", true},
+		{"lecture.mp4", false}, // exclude wins over include
+		{"video.mp4", false},
+		{"notes.txt", false}, // not included
+	}
+	for _, test := range tests {
+		if got := matchFilters(test.name, include, exclude); got != test.want {
+			t.Errorf("matchFilters(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+	if !matchFilters("notes.txt", nil, exclude) {
+		t.Error("without include patterns, the names not excluded must pass")
+	}
+}
+
+func TestCopyFilesFilters(t *testing.T) {
+	backup := newBackup(
+		testFile{ID: "1", Filename: "notes.pdf", Content: "pdf"},
+		testFile{ID: "2", Filename: "video.mp4", Content: "mp4"},
+		testFile{ID: "3", Filename: "notes.txt", Content: "txt"},
+		testFile{ID: "4", Filename: "slides.pdf.mp4", Content: "pdf and mp4"},
+	)
+	destination := t.TempDir()
+
+	result, err := Extract(context.Background(), backup, destination, Options{Include: []string{"*.pdf", "*.mp4"}, Exclude: []string{"*.mp4"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Copied != 1 || result.Skipped != 3 {
+		t.Errorf("got %d copied and %d skipped files, want 1 and 3", result.Copied, result.Skipped)
+	}
+	assertTree(t, destination, map[string]string{"notes.pdf": "pdf"})
+}
+
+func TestCopyFilesStableOrder(t *testing.T) {
+	// the same destination for files with different contents, resolved in the order of the IDs
+	backup := newBackup(
+		testFile{ID: "3", Filename: "doc.pdf", Content: "third"},
+		testFile{ID: "10", Filename: "doc.pdf", Content: "tenth"},
+		testFile{ID: "2", Filename: "doc.pdf", Content: "second"},
+		testFile{ID: "4", Filename: "doc.pdf", Content: "fourth"},
+	)
+	want := map[string]string{"doc.pdf": "tenth", "doc (2).pdf": "second", "doc (3).pdf": "third", "doc (4).pdf": "fourth"}
+
+	// the map iteration and the workers must not change the result
+	for range 10 {
+		destination := t.TempDir()
+		if _, err := Extract(context.Background(), backup, destination, Options{OnCollision: "rename", Jobs: 4}); err != nil {
+			t.Fatal(err)
+		}
+		assertTree(t, destination, want)
+	}
+	for range 10 {
+		destination := t.TempDir()
+		if _, err := Extract(context.Background(), backup, destination, Options{Jobs: 4}); err != nil {
+			t.Fatal(err)
+		}
+		assertTree(t, destination, map[string]string{"doc.pdf": "tenth"})
+	}
+}
+
+// failingReader returns its content, then an error.
+type failingReader struct {
+	content io.Reader
+}
+
+func (r failingReader) Read(p []byte) (int, error) {
+	n, err := r.content.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection lost")
+	}
+	return n, err
+}
+
+func TestCopyContentFailure(t *testing.T) {
+	destination := t.TempDir()
+	c := newTestCopier(Options{}, destination)
+	destinationPath := filepath.Join(destination, "a.pdf")
+
+	// the partial copy is removed, and its bytes are not counted as done
+	_, err := c.copyContent(File{ID: "1"}, failingReader{strings.NewReader("partial content")}, destinationPath)
+	if err == nil {
+		t.Fatal("the copy did not fail")
+	}
+	if done := c.progress.done.Load(); done != 0 {
+		t.Errorf("got %d bytes done after a failed copy, want 0", done)
+	}
+	if _, err := os.Stat(destinationPath); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the partial copy was not removed: %v", err)
+	}
+
+	// a successful retry counts the bytes once
+	written, err := c.copyContent(File{ID: "1"}, strings.NewReader("full content"), destinationPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done := c.progress.done.Load(); done != written {
+		t.Errorf("got %d bytes done, want %d", done, written)
+	}
+}
+
+func TestExtractUnknownSize(t *testing.T) {
+	// the first file has no <filesize>, the second one is empty
+	backup := newBackup(testFile{ID: "2", Filename: "empty.txt", Content: ""})
+	backup["files/a9/a9993e364706816aba3e25717850c26c9cd0d89d"] = &fstest.MapFile{Data: []byte("abc")}
+	backup["files.xml"] = &fstest.MapFile{Data: []byte(`<files>
+<file id="1"><contenthash>a9993e364706816aba3e25717850c26c9cd0d89d</contenthash><filepath>/</filepath><filename>unknown.txt</filename></file>
+<file id="2"><contenthash>da39a3ee5e6b4b0d3255bfef95601890afd80709</contenthash><filepath>/</filepath><filename>empty.txt</filename><filesize>0</filesize></file>
+</files>`)}
+	logs := captureLogs(t)
+
+	destination := t.TempDir()
+	result, err := Extract(context.Background(), backup, destination, Options{ExcludeEmpty: true, MinSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the file of unknown size is neither empty nor filtered out by the size
+	assertTree(t, destination, map[string]string{"unknown.txt": "abc"})
+	if result.Copied != 1 || result.Empty != 0 {
+		t.Errorf("got %d copied and %d empty files, want 1 and 0", result.Copied, result.Empty)
+	}
+	if strings.Contains(logs.String(), "size mismatch") {
+		t.Errorf("size mismatch reported for a file of unknown size:\n%s", logs)
+	}
+
+	// the declared empty file is skipped as empty
+	result, err = Extract(context.Background(), backup, t.TempDir(), Options{ExcludeEmpty: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Copied != 1 || result.Empty != 1 {
+		t.Errorf("got %d copied and %d empty files, want 1 and 1", result.Copied, result.Empty)
+	}
+}
+
+func TestCheckDestination(t *testing.T) {
+	folder := t.TempDir()
+	file := filepath.Join(folder, "output.zip")
+	writeFile(t, file, "zip", time.Now())
+	tests := []struct {
+		destination string
+		format      string
+		ok          bool
+	}{
+		{folder, "dir", true},
+		{file, "dir", false},
+		{filepath.Join(folder, "missing"), "dir", true},
+		{file, "zip", true},
+		{folder, "zip", false},
+		{folder, "tar", false},
+	}
+	for _, test := range tests {
+		err := Options{OutputFormat: test.format}.CheckDestination(test.destination)
+		if (err == nil) != test.ok {
+			t.Errorf("CheckDestination(%s) with %s = %v, want ok %v", test.destination, test.format, err, test.ok)
+		}
+	}
+	if _, err := Extract(context.Background(), courseBackup(), file, Options{}); err == nil {
+		t.Errorf("Extract to the file %s did not fail", file)
+	}
+}
+
+func TestExtractSession(t *testing.T) {
+	destination := t.TempDir()
+	first := newBackup(testFile{ID: "1", Filename: "a.pdf", Content: "first"})
+	second := newBackup(
+		testFile{ID: "1", Filename: "a.pdf", Content: "second"},
+		testFile{ID: "2", Filename: "copy.pdf", Content: "first"},
+	)
+	session := &Session{}
+	opts := Options{OnCollision: "overwrite", Dedup: "hardlink", Session: session}
+
+	if _, err := Extract(context.Background(), first, destination, opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Extract(context.Background(), second, destination, opts); err != nil {
+		t.Fatal(err)
+	}
+	// the file written by the first extraction is not overwritten by the second one
+	assertTree(t, destination, map[string]string{"a.pdf": "first", "copy.pdf": "first"})
+	a, errA := os.Stat(filepath.Join(destination, "a.pdf"))
+	copied, errCopy := os.Stat(filepath.Join(destination, "copy.pdf"))
+	if errA != nil || errCopy != nil || !os.SameFile(a, copied) {
+		t.Errorf("copy.pdf is not linked to the a.pdf of the first extraction (%v, %v)", errA, errCopy)
+	}
+
+	// without a session, the second extraction overwrites the first one
+	destination = t.TempDir()
+	opts.Session = nil
+	for _, backup := range []fstest.MapFS{first, second} {
+		if _, err := Extract(context.Background(), backup, destination, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertTree(t, destination, map[string]string{"a.pdf": "second", "copy.pdf": "first"})
+}
+
+func TestCopyFilesOverwriteHardlink(t *testing.T) {
+	destination := t.TempDir()
+	backup := newBackup(
+		testFile{ID: "1", Filename: "a.txt", Content: "old"},
+		testFile{ID: "2", Filename: "b.txt", Content: "old"},
+	)
+	if _, err := Extract(context.Background(), backup, destination, Options{Dedup: "hardlink", Jobs: 1}); err != nil {
+		t.Fatal(err)
+	}
+	a, errA := os.Stat(filepath.Join(destination, "a.txt"))
+	b, errB := os.Stat(filepath.Join(destination, "b.txt"))
+	if errA != nil || errB != nil || !os.SameFile(a, b) {
+		t.Fatalf("b.txt is not linked to a.txt (%v, %v)", errA, errB)
+	}
+
+	// overwriting b.txt does not change a.txt, that shares its content
+	backup = newBackup(testFile{ID: "2", Filename: "b.txt", Content: "new"})
+	for _, policy := range []string{"overwrite", "newer"} {
+		if _, err := Extract(context.Background(), backup, destination, Options{OnCollision: policy}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertTree(t, destination, map[string]string{"a.txt": "old", "b.txt": "new"})
+}
@@ -0,0 +1,92 @@
+package mfe
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// Status of a file in Diff
+const (
+	DiffNew     = "new"     // the destination file does not exist
+	DiffSame    = "same"    // the destination file has the content of the file
+	DiffChanged = "changed" // the destination file has another content
+)
+
+// DiffEntry is a file of the backup compared to the destination folder.
+type DiffEntry struct {
+	Path   string // slash-separated path relative to the destination folder
+	Status string // DiffNew, DiffSame or DiffChanged
+
+	sortorder int // position of the file in its folder
+}
+
+// Diff compares the files that would be extracted from the Moodle backup source to the files
+// already in the destination folder, without writing anything: the SHA-1 of each existing file
+// is compared to the content hash of the file in the backup.
+// The entries are sorted like the ones of List. The collision policy is not applied,
+// so a file renamed on collision (like with --flat) is compared to the file at its original path.
+func Diff(source fs.FS, destinationFolder string, opts Options) ([]DiffEntry, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.toArchive() {
+		return nil, fmt.Errorf("--diff is not supported with --output-format %s", opts.OutputFormat)
+	}
+
+	// find the files in the source and where to put them
+	fileMapping, err := mapFiles(source, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// compare the files that pass the filters to the destination files
+	var entries []DiffEntry
+	for _, file := range fileMapping {
+		if !opts.selected(file) {
+			continue
+		}
+		entry := DiffEntry{Path: relativePath(file, opts), sortorder: file.Sortorder}
+		sum, err := hashFile(filepath.Join(destinationFolder, filepath.FromSlash(entry.Path)))
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			entry.Status = DiffNew
+		case err != nil:
+			return nil, err
+		case sum == file.ContentHash:
+			entry.Status = DiffSame
+		default:
+			entry.Status = DiffChanged
+		}
+		entries = append(entries, entry)
+	}
+
+	slices.SortFunc(entries, func(a, b DiffEntry) int {
+		return compareEntries(a.Path, a.sortorder, b.Path, b.sortorder)
+	})
+	return entries, nil
+}
+
+// hashFile returns the hex-encoded SHA-1 of the content of a file, like a Moodle content hash.
+// A folder at this path has an empty hash, so it differs from any file.
+func hashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("error opening file %s: %w", filePath, err)
+	}
+	defer file.Close()
+	if info, err := file.Stat(); err == nil && info.IsDir() {
+		return "", nil
+	}
+	hash := sha1.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("error reading file %s: %w", filePath, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
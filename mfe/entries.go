@@ -0,0 +1,191 @@
+package mfe
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+)
+
+// entryAreas are the file areas of the files attached to the entries of the glossaries and databases, by component.
+// The item ID of a glossary file is the ID of its entry, the one of a database file is the ID of its content.
+var entryAreas = map[string][]string{
+	"mod_glossary": {"attachment", "entry"},
+	"mod_data":     {"content"},
+}
+
+// readGlossaryEntries reads the name of the glossary and the concept of each entry (by entry ID)
+// from the glossary.xml file of the glossary.
+// The glossary.xml structure is like this:
+// ```xml
+// <activity>
+//
+//	<glossary id="3">
+//		<name>Vocabulary</name>
+//		<entries>
+//			<entry id="21">
+//				<concept>Photosynthesis</concept>
+//				...
+//			</entry>
+//		</entries>
+//		...
+//	</glossary>
+//
+// </activity>
+// ```
+func readGlossaryEntries(source fs.FS, activityPath string) (string, map[string]string, error) {
+	// Open the glossary.xml file
+	glossaryXMLPath := path.Join(activityPath, "glossary.xml")
+	glossaryFile, err := source.Open(glossaryXMLPath)
+	if err != nil {
+		return "", nil, fmt.Errorf("glossary.xml not found in %s", activityPath)
+	}
+	defer glossaryFile.Close()
+
+	// Parse the glossary.xml file
+	var glossaryData struct {
+		Glossary struct {
+			Name    string `xml:"name"`
+			Entries []struct {
+				ID      string `xml:"id,attr"`
+				Concept string `xml:"concept"`
+			} `xml:"entries>entry"`
+		} `xml:"glossary"`
+	}
+	if err := parseXMLFile(glossaryFile, &glossaryData); err != nil {
+		return "", nil, fmt.Errorf("error parsing %s: %w", glossaryXMLPath, err)
+	}
+
+	entries := make(map[string]string, len(glossaryData.Glossary.Entries))
+	for _, entry := range glossaryData.Glossary.Entries {
+		entries[entry.ID] = entryFolderName(entry.Concept, entry.ID)
+	}
+	return glossaryData.Glossary.Name, entries, nil
+}
+
+// readDatabaseRecords reads the name of the database and the record of each content
+// (by content ID) from the data.xml file of the database. The records have no title,
+// so their folder is named after their ID (like Entry 8).
+// The data.xml structure is like this:
+// ```xml
+// <activity>
+//
+//	<data id="4">
+//		<name>Shared resources</name>
+//		<records>
+//			<record id="8">
+//				<contents>
+//					<content id="31">...</content>
+//				</contents>
+//				...
+//			</record>
+//		</records>
+//		...
+//	</data>
+//
+// </activity>
+// ```
+func readDatabaseRecords(source fs.FS, activityPath string) (string, map[string]string, error) {
+	// Open the data.xml file
+	dataXMLPath := path.Join(activityPath, "data.xml")
+	dataFile, err := source.Open(dataXMLPath)
+	if err != nil {
+		return "", nil, fmt.Errorf("data.xml not found in %s", activityPath)
+	}
+	defer dataFile.Close()
+
+	// Parse the data.xml file
+	var databaseData struct {
+		Data struct {
+			Name    string `xml:"name"`
+			Records []struct {
+				ID       string `xml:"id,attr"`
+				Contents []struct {
+					ID string `xml:"id,attr"`
+				} `xml:"contents>content"`
+			} `xml:"records>record"`
+		} `xml:"data"`
+	}
+	if err := parseXMLFile(dataFile, &databaseData); err != nil {
+		return "", nil, fmt.Errorf("error parsing %s: %w", dataXMLPath, err)
+	}
+
+	records := make(map[string]string)
+	for _, record := range databaseData.Data.Records {
+		for _, content := range record.Contents {
+			records[content.ID] = entryFolderName("", record.ID)
+		}
+	}
+	return databaseData.Data.Name, records, nil
+}
+
+// entryFolderName returns the folder name of an entry: its sanitized title, or Entry <ID> without title.
+func entryFolderName(title string, id string) string {
+	if name := sanitizeFileName(title); name != "" {
+		return name
+	}
+	return "Entry " + id
+}
+
+// processEntries groups the files attached to the entries of the glossaries and databases
+// in the folder <activity>/<entry>, named after the concept of a glossary entry,
+// or the ID of a database record (that has no title).
+// The files are referenced by the inforef.xml of the activity, and their item ID is
+// the ID of the entry (glossary) or of a content of the record (database).
+func processEntries(source fs.FS, activitiesFolder string, fileMapping map[string]File) error {
+	// Read the activities folder
+	dirs, err := fs.ReadDir(source, activitiesFolder)
+	if err != nil {
+		return fmt.Errorf("error reading activities folder: %w", err)
+	}
+
+	for _, dir := range dirs {
+		folderPath := path.Join(activitiesFolder, dir.Name())
+
+		// Read the activity and the folder of each item ID
+		var activityName string
+		var entries map[string]string
+		switch {
+		case strings.HasPrefix(dir.Name(), "glossary_"):
+			activityName, entries, err = readGlossaryEntries(source, folderPath)
+		case strings.HasPrefix(dir.Name(), "data_"):
+			activityName, entries, err = readDatabaseRecords(source, folderPath)
+		default:
+			continue
+		}
+		if err != nil {
+			Logger.Warn("error reading the activity", "activity", folderPath, "error", err)
+			continue
+		}
+
+		// Read the file references from the inforef.xml file
+		fileIDs, err := readInforef(source, folderPath)
+		if err != nil {
+			Logger.Warn("error reading the file references", "activity", folderPath, "error", err)
+			continue
+		}
+
+		// Assign the folder of its entry to each attached file
+		for _, id := range fileIDs {
+			file, exists := fileMapping[id]
+			if !exists || !isEntryFile(file) {
+				continue
+			}
+			entry, ok := entries[file.Itemid]
+			if !ok {
+				Logger.Debug("entry of the file not found", "id", id, "itemid", file.Itemid, "activity", folderPath)
+				continue
+			}
+			file.Folder = path.Join(sanitizeFileName(activityName), entry)
+			fileMapping[id] = file
+			Logger.Debug("assigned folder", "id", id, "folder", file.Folder)
+		}
+	}
+	return nil
+}
+
+// isEntryFile reports whether the file is attached to an entry of a glossary or a database.
+func isEntryFile(file File) bool {
+	return slices.Contains(entryAreas[file.Component], file.Filearea)
+}
@@ -0,0 +1,90 @@
+package mfe
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ExternalsPolicies lists the supported values of the --externals flag,
+// what to do with the files of external repositories whose content is not in the backup.
+var ExternalsPolicies = []string{"skip", "shortcut"}
+
+// shortcutSuffix is the extension of the internet shortcut files written for the external files.
+const shortcutSuffix = ".url"
+
+// isExternal reports whether the file is a reference to an external repository (like a URL or Google Drive).
+func (f File) isExternal() bool {
+	return f.Repositorytype != "" && f.Repositorytype != "$@NULL@$"
+}
+
+// externalURL returns the URL of an external file, if its reference is a URL (like for the url repository).
+func (f File) externalURL() (string, bool) {
+	reference := strings.TrimSpace(f.Reference)
+	if strings.HasPrefix(reference, "http://") || strings.HasPrefix(reference, "https://") {
+		return reference, true
+	}
+	return "", false
+}
+
+// planExternal handles an external file without content in the backup: it is skipped,
+// or with the shortcut policy replaced by an internet shortcut (<filename>.url) to its URL.
+// The shortcut is small, so it is written right away instead of being sent to the workers.
+func (c *copier) planExternal(file File, destinationPath string) copyResult {
+	url, ok := file.externalURL()
+	if c.Externals != "shortcut" || !ok {
+		logVerbose("skipped", "reason", "external", "id", file.ID, "repository", file.Repositorytype, "dest", destinationPath)
+		return copyResult{Status: statusExternal, Destination: destinationPath}
+	}
+
+	// The Windows internet shortcut format, also opened by most desktops
+	content := []byte("[InternetShortcut]\r\nURL=" + url + "\r\n")
+	result := copyResult{Status: statusFailed, Size: int64(len(content))}
+
+	// Apply the collision policy if the shortcut already exists
+	destinationPath, ok, err := c.resolveDestination(destinationPath+shortcutSuffix, c.collisionPolicy(), file)
+	if err != nil {
+		return result.fail(err)
+	}
+	result.Destination = destinationPath
+	if !ok {
+		result.Status = statusSkipped
+		return result
+	}
+
+	// In dry-run mode only report what would be created
+	if c.DryRun {
+		logVerbose("planned", "id", file.ID, "dest", destinationPath, "url", url)
+		result.Status = statusPlanned
+		return result
+	}
+
+	// Write the shortcut to the archive or to the destination folder
+	if c.archive != nil {
+		if _, err := c.archive.add(destinationPath, result.Size, time.Now(), bytes.NewReader(content)); err != nil {
+			return result.fail(err)
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(destinationPath), os.ModePerm); err != nil {
+			return result.fail(fmt.Errorf("error creating directory %s: %w", filepath.Dir(destinationPath), err))
+		}
+		shortcut, err := c.createFile(destinationPath)
+		if err != nil {
+			return result.fail(fmt.Errorf("error creating shortcut %s: %w", destinationPath, err))
+		}
+		_, err = shortcut.Write(content)
+		if closeErr := shortcut.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(destinationPath)
+			return result.fail(fmt.Errorf("error writing shortcut %s: %w", destinationPath, err))
+		}
+	}
+	logVerbose("shortcut", "id", file.ID, "dest", destinationPath, "url", url)
+	result.Status = statusShortcut
+	return result
+}
@@ -0,0 +1,245 @@
+package mfe
+
+import (
+	"cmp"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/fs"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// relativePath returns the slash-separated path of the file relative to the destination folder.
+func relativePath(file File, opts Options) string {
+	// Add the ID to the filename to find the file in the backup
+	file.Filename = withID(file.Filename, file.ID, opts.PreserveIDs)
+
+	// The files without folder go to the LooseFilesDir folder, if any
+	folder := file.Folder
+	if folder == "" {
+		folder = sanitizeFileName(opts.LooseFilesDir)
+	}
+
+	// Empty section, folder and filepath are ignored by path.Join
+	relativePath := path.Join(file.Section, folder, sanitizeFilepath(file.Filepath), file.Filename)
+	if opts.Flat {
+		relativePath = file.Filename
+	}
+	// The name template replaces the layout of the folders (the errors are caught by Validate)
+	if opts.NameTemplate != "" {
+		if rendered, err := templatePath(opts.NameTemplate, file, folder); err == nil {
+			relativePath = rendered
+		} else {
+			Logger.Warn("name template not applied", "id", file.ID, "error", err)
+		}
+	}
+
+	// Prefix the filename with its folders instead of creating subfolders (Topic 1 - lecture.pdf)
+	if opts.FolderPrefix != "" {
+		relativePath = strings.ReplaceAll(relativePath, "/", opts.FolderPrefix)
+	}
+
+	// Join the folders deeper than MaxDepth with underscores
+	if opts.MaxDepth > 0 {
+		relativePath = limitDepth(relativePath, opts.MaxDepth)
+	}
+
+	// Transliterate each part of the path to ASCII
+	if opts.ASCII {
+		parts := strings.Split(relativePath, "/")
+		for i, part := range parts {
+			parts[i] = sanitizeFileName(toASCII(part))
+		}
+		relativePath = path.Join(parts...)
+	}
+
+	// Lowercase the whole path, including the extensions
+	if opts.Lowercase {
+		relativePath = strings.ToLower(relativePath)
+	}
+
+	// Truncate the too long names
+	parts := strings.Split(relativePath, "/")
+	for i, part := range parts {
+		parts[i] = truncateName(part, opts.maxNameLen())
+	}
+	return path.Join(parts...)
+}
+
+// PreserveIDsModes lists the supported values of the --preserve-ids flag.
+var PreserveIDsModes = []string{"prefix", "suffix"}
+
+// withID adds the ID of a file to its filename: before it with the prefix mode (123_name.pdf),
+// or before its extension with the suffix mode (name_123.pdf). Other modes keep the filename.
+func withID(filename string, id string, mode string) string {
+	switch mode {
+	case "prefix":
+		return id + "_" + filename
+	case "suffix":
+		ext := path.Ext(filename)
+		// A name like .htaccess has no extension
+		if ext == filename {
+			ext = ""
+		}
+		return strings.TrimSuffix(filename, ext) + "_" + id + ext
+	}
+	return filename
+}
+
+// DefaultMaxNameLen is the maximum length in bytes of a file name on most filesystems.
+const DefaultMaxNameLen = 255
+
+// maxNameLen returns the maximum length in bytes of the folder and file names, MaxNameLen or DefaultMaxNameLen.
+func (opts Options) maxNameLen() int {
+	if opts.MaxNameLen == 0 {
+		return DefaultMaxNameLen
+	}
+	return opts.MaxNameLen
+}
+
+// truncateName truncates a name longer than maxLen bytes, keeping its extension.
+// A short hash of the full name is appended to the truncated name (like long~1a2b3c4d.pdf),
+// so that the names that differ only after the truncation stay different.
+func truncateName(name string, maxLen int) string {
+	if len(name) <= maxLen {
+		return name
+	}
+	sum := sha1.Sum([]byte(name))
+	suffix := "~" + hex.EncodeToString(sum[:4])
+	// Keep the extension only if it looks like one and fits
+	ext := path.Ext(name)
+	if len(ext) > 16 || len(ext)+len(suffix) >= maxLen {
+		ext = ""
+	}
+	base := strings.TrimSuffix(name, ext)
+
+	// Cut the base name on a character boundary
+	cut := max(maxLen-len(ext)-len(suffix), 0)
+	for cut > 0 && !utf8.RuneStart(base[cut]) {
+		cut--
+	}
+	return base[:cut] + suffix + ext
+}
+
+// limitDepth joins the folders of a slash-separated path deeper than maxDepth with underscores,
+// like a/b/c/d/file.txt with maxDepth 2 to a/b_c_d/file.txt.
+func limitDepth(relativePath string, maxDepth int) string {
+	parts := strings.Split(relativePath, "/")
+	folders, filename := parts[:len(parts)-1], parts[len(parts)-1]
+	if len(folders) <= maxDepth {
+		return relativePath
+	}
+	collapsed := strings.Join(folders[maxDepth-1:], "_")
+	return path.Join(path.Join(folders[:maxDepth-1]...), collapsed, filename)
+}
+
+// ListFiles returns the files of the Moodle backup source with their folders assigned
+// (with the default options), sorted by ID.
+// The Folder of a file is empty if the file is not grouped in a folder (like the single file of a resource),
+// and its Filename is sanitized (the name in the backup is in OriginalFilename).
+func ListFiles(source fs.FS) ([]File, error) {
+	fileMapping, err := mapFiles(source, Options{})
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]File, 0, len(fileMapping))
+	for _, id := range sortedIDs(fileMapping) {
+		files = append(files, fileMapping[id])
+	}
+	return files, nil
+}
+
+// ListEntry is a file that would be extracted from the backup.
+type ListEntry struct {
+	Path string // slash-separated path relative to the destination folder
+	Size int64  // size of the file in bytes, or -1 if its content is missing
+
+	sortorder int // position of the file in its folder
+}
+
+// List returns the files that would be extracted from the Moodle backup source,
+// sorted by folder, then in the Moodle order of each folder (sortorder, then name), without copying anything.
+func List(source fs.FS, opts Options) ([]ListEntry, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	// find the files in the source and where to put them
+	fileMapping, err := mapFiles(source, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// collect the files that pass the filters
+	var entries []ListEntry
+	for _, file := range fileMapping {
+		if !opts.selected(file) {
+			continue
+		}
+		entry := ListEntry{Path: relativePath(file, opts), Size: -1, sortorder: file.Sortorder}
+		if blobPath, err := locateBlob(source, file.ContentHash); err == nil {
+			if info, err := fs.Stat(source, blobPath); err == nil {
+				entry.Size = info.Size()
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	slices.SortFunc(entries, func(a, b ListEntry) int {
+		return compareEntries(a.Path, a.sortorder, b.Path, b.sortorder)
+	})
+	return entries, nil
+}
+
+// selected reports whether a file passes the filters of the options (name, size, date and empty files).
+func (opts Options) selected(file File) bool {
+	return matchFilters(file.Filename, opts.Include, opts.Exclude) && opts.matchSize(file.Filesize) && opts.matchSince(file) && !(opts.ExcludeEmpty && file.isEmpty())
+}
+
+// compareEntries compares two slash-separated destination paths in the listing order:
+// by folder, part by part to keep the subfolders after their parent, then by sortorder, then by path.
+func compareEntries(aPath string, aSortorder int, bPath string, bSortorder int) int {
+	return cmp.Or(
+		slices.Compare(strings.Split(path.Dir(aPath), "/"), strings.Split(path.Dir(bPath), "/")),
+		cmp.Compare(aSortorder, bSortorder),
+		strings.Compare(aPath, bPath),
+	)
+}
+
+// Duplicates returns the groups of files of the Moodle backup source that have the same (sanitized) filename,
+// even in different folders, like the same document uploaded again in another activity.
+// The groups are sorted by filename, and the files of a group by ID.
+func Duplicates(source fs.FS, opts Options) ([][]File, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	// find the files in the source and their folders
+	fileMapping, err := mapFiles(source, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// group the files by filename
+	byName := make(map[string][]File)
+	for _, id := range sortedIDs(fileMapping) {
+		file := fileMapping[id]
+		byName[file.Filename] = append(byName[file.Filename], file)
+	}
+
+	// keep the names of several files
+	var groups [][]File
+	for _, files := range byName {
+		if len(files) > 1 {
+			groups = append(groups, files)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i][0].Filename < groups[j][0].Filename
+	})
+	return groups, nil
+}
@@ -0,0 +1,133 @@
+package mfe
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRelativePathLooseFilesDir(t *testing.T) {
+	tests := []struct {
+		file File
+		want string
+	}{
+		{File{Filename: "loose.txt"}, "_loose/loose.txt"},
+		{File{Filename: "b.txt", Filepath: "/week 1/"}, "_loose/week 1/b.txt"},
+		{File{Filename: "summary.png", Section: "Topic 1"}, "Topic 1/_loose/summary.png"},
+		// the files of a folder are not moved
+		{File{Filename: "a.pdf", Folder: "Lecture notes"}, "Lecture notes/a.pdf"},
+	}
+	for _, test := range tests {
+		if got := relativePath(test.file, Options{LooseFilesDir: "_loose"}); got != test.want {
+			t.Errorf("relativePath(%q) = %q, want %q", test.file.Filename, got, test.want)
+		}
+	}
+	// an empty folder name keeps the files at the top
+	if got := relativePath(File{Filename: "loose.txt"}, Options{}); got != "loose.txt" {
+		t.Errorf("got %q without --loose-files-dir, want \"loose.txt\"", got)
+	}
+}
+
+func TestExtractLooseFilesDir(t *testing.T) {
+	destination := t.TempDir()
+	if _, err := Extract(context.Background(), courseBackup(), destination, Options{LooseFilesDir: "_loose"}); err != nil {
+		t.Fatal(err)
+	}
+	assertTree(t, destination, map[string]string{
+		"Lecture notes/a.pdf":        "first",
+		"Lecture notes/week 1/b.txt": "second",
+		"_loose/single.pdf":          "third",
+		"Course files/image.png":     "fourth",
+		"Topic 1/summary.png":        "fifth",
+		"_loose/loose.txt":           "sixth",
+	})
+}
+
+func TestWithID(t *testing.T) {
+	tests := []struct {
+		filename string
+		mode     string
+		want     string
+	}{
+		{"notes.pdf", "prefix", "123_notes.pdf"},
+		{"notes.pdf", "suffix", "notes_123.pdf"},
+		{"archive.tar.gz", "suffix", "archive.tar_123.gz"},
+		{"README", "suffix", "README_123"},
+		{".htaccess", "suffix", ".htaccess_123"},
+		{".htaccess", "prefix", "123_.htaccess"},
+		{"notes.pdf", "", "notes.pdf"},
+	}
+	for _, test := range tests {
+		if got := withID(test.filename, "123", test.mode); got != test.want {
+			t.Errorf("withID(%q, %q) = %q, want %q", test.filename, test.mode, got, test.want)
+		}
+	}
+}
+
+func TestExtractPreserveIDs(t *testing.T) {
+	backup := newBackup(
+		testFile{ID: "7", Filename: "doc.pdf", Content: "seventh"},
+		testFile{ID: "8", Filename: "doc.pdf", Content: "eighth"},
+	)
+	destination := t.TempDir()
+	if _, err := Extract(context.Background(), backup, destination, Options{PreserveIDs: "suffix"}); err != nil {
+		t.Fatal(err)
+	}
+	// the files with the same name no longer collide
+	assertTree(t, destination, map[string]string{"doc_7.pdf": "seventh", "doc_8.pdf": "eighth"})
+}
+
+func TestExtractLowercase(t *testing.T) {
+	backup := newBackup(
+		testFile{ID: "1", Filepath: "/Week 1/", Filename: "Notes.PDF", Content: "first"},
+		testFile{ID: "2", Filepath: "/week 1/", Filename: "notes.pdf", Content: "second"},
+	)
+	addActivity(backup, "activities/folder_1", "Lecture Notes", "1", "2")
+
+	// the lowercased names collide, even on a case-sensitive filesystem
+	destination := t.TempDir()
+	if _, err := Extract(context.Background(), backup, destination, Options{Lowercase: true, OnCollision: "rename"}); err != nil {
+		t.Fatal(err)
+	}
+	assertTree(t, destination, map[string]string{
+		"lecture notes/week 1/notes.pdf":     "first",
+		"lecture notes/week 1/notes (2).pdf": "second",
+	})
+
+	// without Lowercase, the names that differ only by case collide with CaseInsensitive
+	backup = newBackup(
+		testFile{ID: "1", Filename: "Notes.PDF", Content: "first"},
+		testFile{ID: "2", Filename: "notes.pdf", Content: "second"},
+	)
+	destination = t.TempDir()
+	if _, err := Extract(context.Background(), backup, destination, Options{CaseInsensitive: true, OnCollision: "rename"}); err != nil {
+		t.Fatal(err)
+	}
+	assertTree(t, destination, map[string]string{"Notes.PDF": "first", "notes (2).pdf": "second"})
+}
+
+func TestExtractRenameLongName(t *testing.T) {
+	longName := strings.Repeat("a", 300) + ".txt"
+	backup := newBackup(testFile{ID: "1", Filename: longName, Content: "first"})
+	destination := t.TempDir()
+	if _, err := Extract(context.Background(), backup, destination, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the renamed names are truncated too
+	backup = newBackup(testFile{ID: "1", Filename: longName, Content: "second"})
+	for range 2 {
+		if _, err := Extract(context.Background(), backup, destination, Options{OnCollision: "rename"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tree := readTree(t, destination)
+	if len(tree) != 3 {
+		t.Errorf("got %d files, want 3", len(tree))
+	}
+	for name := range tree {
+		if len(name) > DefaultMaxNameLen || !strings.HasSuffix(name, ".txt") {
+			t.Errorf("got name %q (%d bytes), want at most %d bytes with the extension", name, len(name), DefaultMaxNameLen)
+		}
+	}
+}
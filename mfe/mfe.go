@@ -0,0 +1,1107 @@
+// Package mfe extracts the files of a Moodle backup (.mbz file or extracted folder).
+package mfe
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Logger receives the log records of the extraction: the main steps at the Info level,
+// the per-file progress at the LevelVerbose level, the problems at the Warn and Error levels
+// and the details of the mapping at the Debug level.
+// By default, the records of level Info and above are written to stderr as text,
+// so that stdout is reserved for the results.
+var Logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// LevelVerbose is the log level of the per-file progress (copied, skipped...), between Debug and Info.
+const LevelVerbose = slog.LevelInfo - 2
+
+// logVerbose logs a per-file progress record at the LevelVerbose level.
+func logVerbose(msg string, args ...any) {
+	Logger.Log(context.Background(), LevelVerbose, msg, args...)
+}
+
+// ErrCopyFailed is returned (wrapping the errors of each file) by Extract when some files failed to copy.
+var ErrCopyFailed = errors.New("some files failed to copy")
+
+// ErrNotBackup is returned by Extract when the source has no files.xml.
+var ErrNotBackup = errors.New("this does not look like a Moodle backup (files.xml not found)")
+
+// ErrUnsupportedSource is returned (wrapped) by GetSource when the source is neither a folder nor a supported archive.
+var ErrUnsupportedSource = errors.New("unsupported source")
+
+// ErrSourceNotFound is returned (wrapped) by GetSource when the source path does not exist, or the URL is not found.
+var ErrSourceNotFound = errors.New("source not found")
+
+// Options holds the options of Extract.
+type Options struct {
+	Sections        bool                    // group the files by course section
+	DryRun          bool                    // report what would be created without writing anything
+	Jobs            int                     // number of files copied in parallel
+	Dedup           string                  // "hardlink" to hardlink the files with an already written content
+	OnCollision     string                  // skip, rename, overwrite or newer for an already existing destination (default skip, or rename if Flat)
+	Flat            bool                    // copy all the files directly in the destination folder
+	Include         []string                // glob patterns of the filenames to copy (all if empty)
+	Exclude         []string                // glob patterns of the filenames to not copy (wins over Include)
+	PreserveTimes   bool                    // set the modification time of the copied files from the backup
+	Verify          bool                    // check the SHA-1 of the copied files against their content hash
+	ASCII           bool                    // transliterate the folder and file names to ASCII
+	KeepUnicodeForm bool                    // do not normalize the file names to the Unicode NFC form
+	ActivityTypes   []string                // activity types whose files are grouped in a folder (DefaultActivityTypes if nil)
+	OnlyActivities  bool                    // copy only the files of the ActivityTypes activities
+	MinSize         int64                   // copy only the files of at least MinSize bytes (declared in files.xml)
+	MaxSize         int64                   // copy only the files of at most MaxSize bytes (no limit if 0)
+	IncludeSystem   bool                    // also copy the system files (see SystemFileAreas)
+	FixExtensions   bool                    // append the extension of the mimetype to the filenames without extension
+	Sidecar         bool                    // write the Moodle metadata of each copied file to <filename>.mfe.json
+	OutputFormat    string                  // dir (default), or tar or zip to write the files to a single archive at the destination
+	Progress        func(done, total int64) // called with the bytes done out of the total while copying (may be called concurrently)
+	Retries         int                     // number of retries of a failed copy, with an exponential backoff
+	MaxDepth        int                     // maximum number of nested folders, the deeper folders are joined with underscores (no limit if 0)
+	MaxNameLen      int                     // maximum length in bytes of the folder and file names (DefaultMaxNameLen if 0)
+	LooseFilesDir   string                  // folder of the files that are not in an activity folder (in the destination or section folder)
+	ExcludeEmpty    bool                    // do not copy the empty files
+	OnlyIDs         []string                // copy only the files with these IDs (all if empty)
+	Since           time.Time               // copy only the files modified at or after this time (all if zero)
+	ByUser          bool                    // group the files submitted to the assignments by user
+	Externals       string                  // what to do with the files of external repositories without content: skip (default) or shortcut
+	KeepJunk        bool                    // also copy the metadata files of macOS and Windows (like .DS_Store and Thumbs.db)
+	NameTemplate    string                  // text/template of the path of the files relative to the destination (like {{.Folder}}/{{.ID}}-{{.Filename}}), the default layout if empty
+	PreserveIDs     string                  // add the ID of each file to its filename: prefix (123_name.pdf) or suffix (name_123.pdf), none if empty
+	Dereference     bool                    // copy the content of the file an alias refers to, instead of the alias
+	CaseInsensitive bool                    // detect the collisions of the destination paths that differ only by case (like Foo.pdf and foo.pdf)
+	FolderPrefix    string                  // separator joining the folders to the filename instead of creating subfolders (like " - ")
+	Safe            bool                    // for network filesystems: copy one file at a time, without hardlinks, and create the files exclusively
+	Orphans         bool                    // also copy the blobs not referenced by files.xml to OrphansFolder, named after their hash
+	UniqueContent   bool                    // copy each content only once, the next files with the same content hash are skipped
+	Lowercase       bool                    // lowercase the folder and file names
+	Manifest        *Manifest               // collects the outcome of each file (if not nil)
+	Session         *Session                // shares the written paths and contents with the other extractions to the same destination (if not nil)
+	BeforeCopy      func(int, int64) error  // called with the number and declared bytes of the files to copy, before writing anything (Extract stops on its error)
+}
+
+// Validate checks the values of the options.
+func (opts Options) Validate() error {
+	if opts.Dedup != "" && opts.Dedup != "hardlink" {
+		return fmt.Errorf("invalid --dedup value %q, only \"hardlink\" is supported", opts.Dedup)
+	}
+	if opts.OnCollision != "" && !slices.Contains(CollisionPolicies, opts.OnCollision) {
+		return fmt.Errorf("invalid --on-collision value %q, use one of: %s", opts.OnCollision, strings.Join(CollisionPolicies, ", "))
+	}
+	if opts.Externals != "" && !slices.Contains(ExternalsPolicies, opts.Externals) {
+		return fmt.Errorf("invalid --externals value %q, use one of: %s", opts.Externals, strings.Join(ExternalsPolicies, ", "))
+	}
+	if opts.PreserveIDs != "" && !slices.Contains(PreserveIDsModes, opts.PreserveIDs) {
+		return fmt.Errorf("invalid --preserve-ids value %q, use one of: %s", opts.PreserveIDs, strings.Join(PreserveIDsModes, ", "))
+	}
+	if opts.OutputFormat != "" && !slices.Contains(OutputFormats, opts.OutputFormat) {
+		return fmt.Errorf("invalid --output-format value %q, use one of: %s", opts.OutputFormat, strings.Join(OutputFormats, ", "))
+	}
+	if opts.toArchive() && opts.Dedup != "" {
+		return fmt.Errorf("--dedup is not supported with --output-format %s", opts.OutputFormat)
+	}
+	if opts.MaxNameLen < 0 || (opts.MaxNameLen > 0 && opts.MaxNameLen < 16) {
+		return fmt.Errorf("invalid --max-name-len value %d, it must be at least 16", opts.MaxNameLen)
+	}
+	if opts.FolderPrefix != "" && forbidden.MatchString(opts.FolderPrefix) {
+		return fmt.Errorf("invalid --folder-as-prefix separator %q, it cannot contain any of <>:\"/\\|?* or control characters", opts.FolderPrefix)
+	}
+	if opts.FolderPrefix != "" && opts.Flat {
+		return fmt.Errorf("--folder-as-prefix cannot be used with --flat")
+	}
+	if opts.LooseFilesDir != "" && strings.Trim(sanitizeFileName(opts.LooseFilesDir), ".") == "" {
+		return fmt.Errorf("invalid --loose-files-dir value %q, it must be a folder name", opts.LooseFilesDir)
+	}
+	if opts.MaxDepth < 0 {
+		return fmt.Errorf("invalid --max-depth value %d, it must not be negative", opts.MaxDepth)
+	}
+	if opts.Retries < 0 {
+		return fmt.Errorf("invalid --retries value %d, it must not be negative", opts.Retries)
+	}
+	if opts.MinSize < 0 || opts.MaxSize < 0 {
+		return fmt.Errorf("invalid size limits, --min-size and --max-size must not be negative")
+	}
+	if opts.MaxSize > 0 && opts.MinSize > opts.MaxSize {
+		return fmt.Errorf("invalid size limits, --min-size %d is greater than --max-size %d", opts.MinSize, opts.MaxSize)
+	}
+	if opts.NameTemplate != "" {
+		if _, err := parseNameTemplate(opts.NameTemplate); err != nil {
+			return err
+		}
+	}
+	for _, pattern := range slices.Concat(opts.Include, opts.Exclude) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Result is the outcome of Extract.
+type Result struct {
+	Stats
+	Duration time.Duration // time taken by the extraction
+}
+
+// mapFiles finds the files in the source and assigns them the activity folders
+// and the sections given by the options.
+func mapFiles(source fs.FS, opts Options) (map[string]File, error) {
+	// find all the files in the source
+	fileMapping, err := buildFileMapping(source, "files.xml", !opts.KeepUnicodeForm, opts.IncludeSystem, opts.KeepJunk)
+	if err != nil {
+		return nil, err
+	}
+
+	// copy the content of the target of the aliases
+	if opts.Dereference {
+		dereferenceAliases(fileMapping)
+	}
+
+	// assign folder names to the files
+	activityTypes := opts.ActivityTypes
+	if activityTypes == nil {
+		activityTypes = DefaultActivityTypes
+	}
+	if err := processActivitiesFolder(source, "activities", fileMapping, activityTypes); err != nil {
+		return nil, err
+	}
+
+	// group the files of the glossary and database entries by entry
+	if err := processEntries(source, "activities", fileMapping); err != nil {
+		return nil, err
+	}
+
+	// group the submitted files of the assignments by user
+	if opts.ByUser {
+		if err := processSubmissions(source, "activities", fileMapping); err != nil {
+			return nil, err
+		}
+	}
+
+	// recover the missing extensions from the mimetypes, or else from the content
+	if opts.FixExtensions {
+		// the content of the files sharing a blob (like aliases) is read once
+		detected := make(map[string]string)
+		for id, file := range fileMapping {
+			file.Filename = fixExtension(file.Filename, file.Mimetype)
+			if path.Ext(file.Filename) == "" {
+				mimetype, ok := detected[file.ContentHash]
+				if !ok {
+					mimetype = detectMimetype(source, file.ContentHash)
+					detected[file.ContentHash] = mimetype
+				}
+				file.Filename = fixExtension(file.Filename, mimetype)
+				Logger.Debug("detected mimetype", "id", id, "mimetype", mimetype, "filename", file.Filename)
+			}
+			fileMapping[id] = file
+		}
+	}
+
+	// group the files of the questions by category
+	processQuestions(source, fileMapping)
+
+	// assign the course and section folders to the remaining files
+	if err := processCourseFiles(source, fileMapping); err != nil {
+		return nil, err
+	}
+
+	// drop the files that don't belong to the processed activity types
+	if opts.OnlyActivities {
+		for id, file := range fileMapping {
+			if file.Activity == "" {
+				delete(fileMapping, id)
+			}
+		}
+	}
+
+	// assign section names to the files
+	if opts.Sections {
+		if err := processSections(source, fileMapping); err != nil {
+			return nil, err
+		}
+	}
+
+	// add the blobs that no file refers to
+	if opts.Orphans {
+		if err := addOrphans(source, fileMapping); err != nil {
+			return nil, err
+		}
+	}
+
+	// keep only the selected files (the orphan blobs too, their IDs are like orphan-<hash>)
+	if len(opts.OnlyIDs) > 0 {
+		for id := range fileMapping {
+			if !slices.Contains(opts.OnlyIDs, id) {
+				delete(fileMapping, id)
+			}
+		}
+		for _, id := range opts.OnlyIDs {
+			if _, exists := fileMapping[id]; !exists {
+				Logger.Warn("selected file not found", "id", id)
+			}
+		}
+	}
+
+	return fileMapping, nil
+}
+
+// Extract extracts the files of the Moodle backup source to the destination folder.
+// If some files failed to copy, the result is returned along with the joined errors.
+// If the context is canceled, the extraction stops between files (or during a copy)
+// and the context error (like context.Canceled) is returned.
+func Extract(ctx context.Context, source fs.FS, destinationFolder string, opts Options) (Result, error) {
+	start := time.Now()
+	if err := opts.Validate(); err != nil {
+		return Result{}, err
+	}
+	if err := opts.CheckDestination(destinationFolder); err != nil {
+		return Result{}, err
+	}
+	// The parallel copies and the hardlinks are not reliable on the network filesystems
+	if opts.Safe {
+		if opts.Dedup != "" {
+			Logger.Warn("--dedup is disabled by --safe")
+		}
+		opts.Jobs = 1
+		opts.Dedup = ""
+	}
+
+	// find the files in the source and where to put them
+	fileMapping, err := mapFiles(source, opts)
+	if err != nil {
+		return Result{}, err
+	}
+
+	// let the caller confirm the extraction (or prepare the destination) with the files to copy
+	if opts.BeforeCopy != nil {
+		files, bytes := 0, int64(0)
+		for _, file := range fileMapping {
+			if opts.selected(file) {
+				files++
+				bytes += max(file.Filesize, 0)
+			}
+		}
+		if err := opts.BeforeCopy(files, bytes); err != nil {
+			return Result{Duration: time.Since(start)}, err
+		}
+	}
+
+	// copy the files to the destination folder
+	stats, err := copyFiles(ctx, source, destinationFolder, fileMapping, opts)
+	result := Result{Stats: stats, Duration: time.Since(start)}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return result, ctxErr
+	}
+	// The errors without failed file are about the destination itself (like a read-only folder)
+	if err != nil && stats.Failed == 0 {
+		return result, err
+	}
+	if err != nil {
+		return result, fmt.Errorf("%w: %w", ErrCopyFailed, err)
+	}
+	return result, nil
+}
+
+// forbidden is a regular expression that matches invalid characters for file names.
+var forbidden = regexp.MustCompile(`[<>:"/\\|?*\x00-\x1F]+`)
+
+// windowsReserved is a regular expression that matches the device names reserved by Windows,
+// alone or followed by an extension (like CON or nul.txt).
+var windowsReserved = regexp.MustCompile(`(?i)^(CON|PRN|AUX|NUL|COM[1-9]|LPT[1-9])(\.|$)`)
+
+// sanitizeFileName replaces the runs of invalid characters in folder and file names with a hyphen.
+// This is used to ensure that folder and file names are valid for file systems, including Windows:
+// the leading and trailing hyphens, dots and spaces (that Windows strips) are removed,
+// and the reserved device names are prefixed with an underscore (CON.txt becomes _CON.txt).
+// A name made only of invalid characters becomes empty.
+func sanitizeFileName(fileName string) string {
+	fileName = forbidden.ReplaceAllString(fileName, "-")
+	// Keep the names made only of dots (like . and ..), they are handled by the callers
+	if strings.Trim(fileName, ".") != "" {
+		fileName = strings.Trim(fileName, "-. ")
+	}
+	if windowsReserved.MatchString(fileName) {
+		fileName = "_" + fileName
+	}
+	return fileName
+}
+
+// asciiReplacements transliterates the letters that are not decomposed by NFD.
+var asciiReplacements = strings.NewReplacer(
+	// Latin letters without decomposition
+	"ß", "ss", "æ", "ae", "Æ", "AE", "œ", "oe", "Œ", "OE", "ø", "o", "Ø", "O",
+	"đ", "d", "Đ", "D", "ł", "l", "Ł", "L", "þ", "th", "Þ", "TH",
+	// Cyrillic letters (Bulgarian and Russian)
+	"а", "a", "б", "b", "в", "v", "г", "g", "д", "d", "е", "e", "ж", "zh", "з", "z",
+	"и", "i", "к", "k", "л", "l", "м", "m", "н", "n", "о", "o", "п", "p", "р", "r",
+	"с", "s", "т", "t", "у", "u", "ф", "f", "х", "h", "ц", "ts", "ч", "ch", "ш", "sh",
+	"щ", "sht", "ъ", "a", "ь", "y", "ю", "yu", "я", "ya", "ы", "y", "э", "e", "ё", "yo",
+	"А", "A", "Б", "B", "В", "V", "Г", "G", "Д", "D", "Е", "E", "Ж", "Zh", "З", "Z",
+	"И", "I", "К", "K", "Л", "L", "М", "M", "Н", "N", "О", "O", "П", "P", "Р", "R",
+	"С", "S", "Т", "T", "У", "U", "Ф", "F", "Х", "H", "Ц", "Ts", "Ч", "Ch", "Ш", "Sh",
+	"Щ", "Sht", "Ъ", "A", "Ь", "Y", "Ю", "Yu", "Я", "Ya", "Ы", "Y", "Э", "E", "Ё", "Yo",
+)
+
+// toASCII transliterates a name to ASCII: accents are removed (é→e) with the NFD decomposition,
+// some letters (including Cyrillic) are transliterated, and other non-ASCII characters become "_".
+func toASCII(name string) string {
+	// Remove the combining marks of the decomposed characters
+	var b strings.Builder
+	for _, r := range norm.NFD.String(name) {
+		if !unicode.Is(unicode.Mn, r) {
+			b.WriteRune(r)
+		}
+	}
+
+	// Transliterate the remaining letters
+	name = asciiReplacements.Replace(norm.NFC.String(b.String()))
+	return strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// preferredExtensions are the extensions of the mimetypes with several extensions
+// (mime.ExtensionsByType returns them in alphabetical order, like .jfif for image/jpeg).
+var preferredExtensions = map[string]string{
+	"audio/mpeg": ".mp3",
+	"image/jpeg": ".jpg",
+	"image/tiff": ".tif",
+	"text/html":  ".html",
+	"text/plain": ".txt",
+	"video/mp4":  ".mp4",
+	"video/mpeg": ".mpg",
+}
+
+// fixExtension appends the extension of the mimetype to a filename without extension.
+// The filename is unchanged if it has an extension or if the mimetype is unknown.
+func fixExtension(filename string, mimetype string) string {
+	if path.Ext(filename) != "" {
+		return filename
+	}
+	if ext, ok := preferredExtensions[mimetype]; ok {
+		return filename + ext
+	}
+	if exts, err := mime.ExtensionsByType(mimetype); err == nil && len(exts) > 0 {
+		return filename + exts[0]
+	}
+	return filename
+}
+
+// detectMimetype returns the mimetype of the content of a blob, detected from its first 512 bytes
+// (see http.DetectContentType), or an empty string if the blob is missing or its type is unknown.
+func detectMimetype(source fs.FS, hash string) string {
+	blobPath, err := locateBlob(source, hash)
+	if err != nil {
+		return ""
+	}
+	blob, err := source.Open(blobPath)
+	if err != nil {
+		return ""
+	}
+	defer blob.Close()
+	header := make([]byte, 512)
+	n, err := io.ReadFull(blob, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return ""
+	}
+	// Drop the parameters, like text/plain; charset=utf-8
+	mimetype, _, _ := strings.Cut(http.DetectContentType(header[:n]), ";")
+	if mimetype == "application/octet-stream" {
+		return ""
+	}
+	return mimetype
+}
+
+// sanitizeFilepath sanitizes each segment of a Moodle filepath (like /images/diagrams/)
+// and returns them joined as a relative path. The root filepath / gives an empty string.
+func sanitizeFilepath(moodlePath string) string {
+	var segments []string
+	for _, segment := range strings.Split(moodlePath, "/") {
+		segment = sanitizeFileName(segment)
+		// Skip empty and special segments
+		if segment == "" || segment == "." || segment == ".." {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	return path.Join(segments...)
+}
+
+// File represents the structure of a file entry in files.xml
+type File struct {
+	ID          string `xml:"id,attr"`
+	ContentHash string `xml:"contenthash"`
+	Component   string `xml:"component"`
+	Filearea    string `xml:"filearea"`
+	Filename    string `xml:"filename"`
+	Filepath    string `xml:"filepath"`
+	Itemid      string `xml:"itemid"` // ID of the item of the component owning the file (like the submission)
+	Userid      string `xml:"userid"` // ID of the user who uploaded the file
+	// Repositorytype and Reference are the type and the reference of an external repository ($@NULL@$ if none)
+	Repositorytype string `xml:"repositorytype"`
+	Reference      string `xml:"reference"`
+	// Referencefileid is the ID of the file an alias refers to ($@NULL@$ if the file is not an alias)
+	Referencefileid string `xml:"referencefileid"`
+	// Filesize is the declared size of the file in bytes, or unknownSize if files.xml does not declare it
+	Filesize int64  `xml:"filesize"`
+	Mimetype string `xml:"mimetype"`
+	Author   string `xml:"author"`
+	License  string `xml:"license"`
+	// Timecreated and Timemodified are the creation and modification times as Unix epoch
+	Timecreated  string `xml:"timecreated"`
+	Timemodified string `xml:"timemodified"`
+	// Sortorder is the position of the file in its folder, as shown by Moodle (0 if not set)
+	Sortorder int `xml:"sortorder"`
+	// OriginalFilename is the filename before sanitization
+	OriginalFilename string `xml:"-"`
+	Folder           string `xml:"-"` // Ignore Folder when XML parsing
+	Section          string `xml:"-"` // Ignore Section when XML parsing
+	Activity         string `xml:"-"` // Directory of the activity of the file (if its type is processed)
+}
+
+// unknownSize is the Filesize of the files whose size is not declared in files.xml.
+const unknownSize = -1
+
+// modificationTime returns the modification time of the file, and false if it is empty or zero.
+func (f File) modificationTime() (time.Time, bool) {
+	epoch, err := strconv.ParseInt(f.Timemodified, 10, 64)
+	if err != nil || epoch <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(epoch, 0), true
+}
+
+// isAlias reports whether the file is an alias (a shortcut) of another file.
+func (f File) isAlias() bool {
+	return f.Referencefileid != "" && f.Referencefileid != "$@NULL@$"
+}
+
+// dereferenceAliases gives to each alias the content hash and the size of the file it refers to,
+// following the aliases of aliases, so that the real content is copied under the name of the alias.
+// The aliases whose target is not in the backup, or that form a cycle, are kept as is with a warning.
+func dereferenceAliases(fileMapping map[string]File) {
+	for id, file := range fileMapping {
+		if !file.isAlias() {
+			continue
+		}
+		// Follow the references until a file that is not an alias
+		target := file
+		visited := map[string]bool{id: true}
+		for target.isAlias() {
+			next, exists := fileMapping[target.Referencefileid]
+			if !exists {
+				Logger.Warn("alias target not found", "id", id, "target", target.Referencefileid)
+				break
+			}
+			if visited[next.ID] {
+				Logger.Warn("alias reference cycle", "id", id, "target", next.ID)
+				break
+			}
+			visited[next.ID] = true
+			target = next
+		}
+		if target.isAlias() {
+			continue
+		}
+		file.ContentHash = target.ContentHash
+		file.Filesize = target.Filesize
+		fileMapping[id] = file
+		Logger.Debug("dereferenced alias", "id", id, "target", target.ID, "hash", target.ContentHash)
+	}
+}
+
+// newXMLDecoder returns an XML decoder that also reads the files declared in another encoding
+// than UTF-8 (like ISO-8859-1 or windows-1252 in older Moodle versions).
+func newXMLDecoder(reader io.Reader) *xml.Decoder {
+	decoder := xml.NewDecoder(reader)
+	decoder.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		encoding, err := htmlindex.Get(label)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported encoding %q: %w", label, err)
+		}
+		return encoding.NewDecoder().Reader(input), nil
+	}
+	return decoder
+}
+
+// parseXMLFile reads XML data from an io.Reader and unmarshals it into the provided struct.
+// It returns an error, with the byte offset of the problem, if the data cannot be read or parsed.
+func parseXMLFile(reader io.Reader, v any) error {
+	decoder := newXMLDecoder(reader)
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("at byte %d: %w", decoder.InputOffset(), err)
+	}
+	return nil
+}
+
+// validContentHash is a regular expression that matches a valid ContentHash (a SHA-1 in hex).
+var validContentHash = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// SystemFileAreas are the file areas, by component, of the system files (thumbnails, icons, drafts)
+// that are not course content and are skipped unless Options.IncludeSystem is set.
+var SystemFileAreas = map[string][]string{
+	"core":  {"preview"},       // thumbnails of the files
+	"user":  {"icon", "draft"}, // profile pictures and draft uploads
+	"group": {"icon"},          // group pictures
+}
+
+// isSystemFile reports whether the file is in one of the SystemFileAreas.
+func isSystemFile(file File) bool {
+	return slices.Contains(SystemFileAreas[file.Component], file.Filearea)
+}
+
+// JunkFileNames are the names of the metadata files of macOS and Windows,
+// that are skipped unless Options.KeepJunk is set.
+var JunkFileNames = []string{".DS_Store", "Thumbs.db", "ehthumbs.db", "desktop.ini"}
+
+// isJunkFile reports whether the file is a metadata file of macOS or Windows: one of the JunkFileNames,
+// an AppleDouble file (like ._report.pdf) or a file of a __MACOSX folder (from a zip made on macOS).
+func isJunkFile(file File) bool {
+	name := file.OriginalFilename
+	if slices.ContainsFunc(JunkFileNames, func(junk string) bool { return strings.EqualFold(name, junk) }) {
+		return true
+	}
+	return strings.HasPrefix(name, "._") || slices.Contains(strings.Split(file.Filepath, "/"), "__MACOSX")
+}
+
+// buildFileMapping reads the files.xml file (see readFilesXML) and builds a mapping of file IDs to File structs.
+// It returns a map where the keys are file IDs and the values are File structs.
+// If normalizeNFC is set, the file names are normalized to the Unicode NFC form.
+// The system files (see SystemFileAreas) are skipped unless includeSystem is set.
+// The parsed files.xml is cached for the last source, so that the mapping of a source
+// listed then extracted (or extracted several times) is built from a single parsing.
+func buildFileMapping(source fs.FS, filesXMLPath string, normalizeNFC bool, includeSystem bool, keepJunk bool) (map[string]File, error) {
+	files, err := parseFilesXML(source, filesXMLPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create a mapping of file IDs to File structs
+	fileMapping := make(map[string]File)
+	for _, file := range files {
+		file.OriginalFilename = file.Filename
+		// Normalize the names to NFC (lossless), to avoid NFD names looking like duplicates
+		if normalizeNFC {
+			file.Filename = norm.NFC.String(file.Filename)
+			file.Filepath = norm.NFC.String(file.Filepath)
+		}
+		file.Filename = sanitizeFileName(file.Filename)
+		// Skip files with empty ID, ContentHash, or useless filename
+		if file.ID == "" || file.ContentHash == "" || file.Filename == "." {
+			continue
+		}
+		// Skip the thumbnails, icons and other system files
+		if !includeSystem && isSystemFile(file) {
+			Logger.Debug("skipped system file", "id", file.ID, "component", file.Component, "filearea", file.Filearea, "filename", file.Filename)
+			continue
+		}
+		// Skip the metadata files of macOS and Windows uploaded by mistake
+		if !keepJunk && isJunkFile(file) {
+			Logger.Debug("skipped junk file", "id", file.ID, "filepath", file.Filepath, "filename", file.OriginalFilename)
+			continue
+		}
+		// Skip files with a malformed ContentHash, it can't be the path of a blob
+		if !validContentHash.MatchString(file.ContentHash) {
+			Logger.Warn("invalid content hash", "id", file.ID, "hash", file.ContentHash)
+			continue
+		}
+		// Name the files without usable filename (like ? or ..) after their content hash
+		if strings.Trim(file.Filename, ".") == "" {
+			file.Filename = fixExtension(file.ContentHash, file.Mimetype)
+			Logger.Warn("unusable filename, using the content hash", "id", file.ID, "filename", file.OriginalFilename, "name", file.Filename)
+		}
+		fileMapping[file.ID] = file
+		Logger.Debug("added to mapping", "id", file.ID, "hash", file.ContentHash, "filename", file.Filename)
+	}
+
+	// Done
+	return fileMapping, nil
+}
+
+// parseFilesXML parses the files.xml file (see readFilesXML), or reuses the files parsed by a previous call on the same source.
+// The returned slice is shared, the callers must not modify its elements.
+func parseFilesXML(source fs.FS, filesXMLPath string) ([]File, error) {
+	if files, ok := parsedFiles.load(source, filesXMLPath); ok {
+		return files, nil
+	}
+	files, err := readFilesXML(source, filesXMLPath)
+	if err != nil {
+		return nil, err
+	}
+	parsedFiles.store(source, filesXMLPath, files)
+	return files, nil
+}
+
+// readFilesXML parses the <file> elements of the files.xml file, without any processing.
+// If files.xml is malformed (like truncated), the files before the malformed part are returned.
+// The files.xml structure is like this:
+// ```xml
+// <files>
+//
+//	<file id="70829635">
+//		<contenthash>da39a3ee5e6b4b0d3255bfef95601890afd80709</contenthash>
+//		<filepath>/</filepath>
+//		<filename>empty.txt</filename>
+//		...
+//	</file>
+//	...
+//
+// </files>
+// ```
+func readFilesXML(source fs.FS, filesXMLPath string) ([]File, error) {
+	// Open the files.xml file
+	file, err := source.Open(filesXMLPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		// A backup without files.xml is broken, otherwise it's not a backup at all
+		if _, errBackup := fs.Stat(source, "moodle_backup.xml"); errBackup == nil {
+			return nil, fmt.Errorf("%w, but moodle_backup.xml is present: the backup may be incomplete", ErrNotBackup)
+		}
+		// The backups made before Moodle 2.0 have a single moodle.xml file and no files.xml
+		if _, errOld := fs.Stat(source, "moodle.xml"); errOld == nil {
+			return nil, fmt.Errorf("%w, but moodle.xml is present: the backups made before Moodle 2.0 are not supported", ErrNotBackup)
+		}
+		return nil, ErrNotBackup
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading files.xml: %w", err)
+	}
+	defer file.Close()
+
+	// Parse the XML file one <file> at a time,
+	// so that the files before a malformed part (like a truncated file) are kept
+	var files []File
+	decoder := newXMLDecoder(file)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			if start, ok := token.(xml.StartElement); ok && start.Name.Local == "file" {
+				// A missing <filesize> is unknown, not 0 (that would make the file look empty)
+				file := File{Filesize: unknownSize}
+				if err = decoder.DecodeElement(&file, &start); err == nil {
+					files = append(files, file)
+				}
+			}
+		}
+		if err != nil && len(files) == 0 {
+			return nil, fmt.Errorf("error parsing files.xml at byte %d: %w", decoder.InputOffset(), err)
+		}
+		if err != nil {
+			Logger.Warn("files.xml is malformed, the next files are ignored", "offset", decoder.InputOffset(), "files", len(files), "error", err)
+			break
+		}
+	}
+	return files, nil
+}
+
+// readInforef reads the inforef.xml file in the given folder and returns the referenced file IDs.
+// The inforef.xml structure is like this:
+// ```xml
+// <inforef>
+//
+//	<fileref>
+//		<file>
+//			<id>70829635</id>
+//		</file>
+//		...
+//	</fileref>
+//
+// </inforef>
+// ```
+func readInforef(source fs.FS, folderPath string) ([]string, error) {
+	// Open the inforef.xml file
+	inforefXMLPath := path.Join(folderPath, "inforef.xml")
+	inforefFile, err := source.Open(inforefXMLPath)
+	if err != nil {
+		return nil, fmt.Errorf("inforef.xml not found in %s", folderPath)
+	}
+	defer inforefFile.Close()
+
+	// Parse the inforef.xml file to get the file references
+	var inforefData struct {
+		Files []struct {
+			ID string `xml:"id"`
+		} `xml:"fileref>file"`
+	}
+	if err := parseXMLFile(inforefFile, &inforefData); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", inforefXMLPath, err)
+	}
+
+	// Collect the file IDs
+	fileIDs := make([]string, 0, len(inforefData.Files))
+	for _, fileref := range inforefData.Files {
+		fileIDs = append(fileIDs, fileref.ID)
+	}
+	return fileIDs, nil
+}
+
+// DefaultActivityTypes is the default list of activity types whose files are grouped in a folder
+// named after the activity. The activity of type xxx is stored in activities/xxx_ID/xxx.xml.
+var DefaultActivityTypes = []string{"folder", "resource"}
+
+// activityType returns the type of the activity stored in the given directory,
+// or an empty string if the type is not in activityTypes.
+func activityType(dirName string, activityTypes []string) string {
+	for _, activityType := range activityTypes {
+		if strings.HasPrefix(dirName, activityType+"_") {
+			return activityType
+		}
+	}
+	return ""
+}
+
+// ActivityNamePaths are the paths of the element with the display name of the activity,
+// by activity type, in its xxx.xml file (relative to the root <activity> element).
+// The types that are not listed use the default path xxx>name.
+var ActivityNamePaths = map[string]string{
+	"folder":   "folder>name",
+	"resource": "resource>name",
+	"assign":   "assign>name",
+	"quiz":     "quiz>name",
+	"page":     "page>name",
+	"url":      "url>name",
+	"book":     "book>name",
+	"forum":    "forum>name",
+	"label":    "label>name",
+}
+
+// activityNamePath returns the path of the element with the name of the activity of the given type.
+func activityNamePath(activityType string) string {
+	if namePath, ok := ActivityNamePaths[activityType]; ok {
+		return namePath
+	}
+	return activityType + ">name"
+}
+
+// readActivityName reads the name of the activity from its xxx.xml file,
+// at the path given by ActivityNamePaths for its type.
+// The xxx.xml structure is like this:
+// ```xml
+// <activity>
+//
+//	<xxx>
+//		<name>Activity name</name>
+//		...
+//	</xxx>
+//
+// </activity>
+// ```
+func readActivityName(source fs.FS, activityPath string, activityType string) (string, error) {
+	// Open the xxx.xml file
+	activityXMLPath := path.Join(activityPath, activityType+".xml")
+	activityFile, err := source.Open(activityXMLPath)
+	if err != nil {
+		return "", fmt.Errorf("%s.xml not found in %s", activityType, activityPath)
+	}
+	defer activityFile.Close()
+
+	// Parse the xxx.xml file to get the activity name
+	name, err := readXMLElement(activityFile, activityNamePath(activityType))
+	if err != nil {
+		return "", fmt.Errorf("error parsing %s: %w", activityXMLPath, err)
+	}
+	return name, nil
+}
+
+// readXMLElement returns the text of the first element at the given path (like assign>name),
+// relative to the root element of the XML document, or an empty string if there is none.
+func readXMLElement(reader io.Reader, elementPath string) (string, error) {
+	decoder := newXMLDecoder(reader)
+	target := strings.Split(elementPath, ">")
+
+	// The stack of the open elements, without the root element
+	var stack []string
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("at byte %d: %w", decoder.InputOffset(), err)
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			if depth > 0 {
+				stack = append(stack, element.Name.Local)
+			}
+			depth++
+			// Read the text of the target element
+			if slices.Equal(stack, target) {
+				var text string
+				if err := decoder.DecodeElement(&text, &element); err != nil {
+					return "", fmt.Errorf("at byte %d: %w", decoder.InputOffset(), err)
+				}
+				return text, nil
+			}
+		case xml.EndElement:
+			depth--
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+}
+
+// processActivitiesFolder processes the activities folder and updates the file mapping
+// with folder names. It reads xxx.xml and inforef.xml files of the activities in activityTypes
+// to extract folder names and associates them with file IDs.
+func processActivitiesFolder(source fs.FS, activitiesFolder string, fileMapping map[string]File, activityTypes []string) error {
+	// Read the activities folder
+	dirs, err := fs.ReadDir(source, activitiesFolder)
+	if err != nil {
+		return fmt.Errorf("error reading activities folder: %w", err)
+	}
+
+	// Loop through the directories in the activities folder
+	for _, dir := range dirs {
+		// Look only inside folders of the supported activity types
+		dirType := activityType(dir.Name(), activityTypes)
+		if dirType == "" {
+			continue
+		}
+		// Construct the path to the xxx_ID directory
+		folderPath := path.Join(activitiesFolder, dir.Name())
+
+		// Read the activity name from the xxx.xml file
+		activityName, err := readActivityName(source, folderPath, dirType)
+		if err != nil {
+			Logger.Warn("error reading the activity", "activity", folderPath, "error", err)
+			continue
+		}
+		folderName := sanitizeFileName(activityName)
+
+		// Read the file references from the inforef.xml file
+		fileIDs, err := readInforef(source, folderPath)
+		if err != nil {
+			Logger.Warn("error reading the file references", "activity", folderPath, "error", err)
+			continue
+		}
+
+		// Remember the activity of the files
+		for _, id := range fileIDs {
+			if file, exists := fileMapping[id]; exists {
+				file.Activity = folderPath
+				fileMapping[id] = file
+			}
+		}
+
+		// A single-file activity (other than a folder) keeps its file ungrouped
+		if dirType != "folder" {
+			count := 0
+			for _, id := range fileIDs {
+				if _, exists := fileMapping[id]; exists {
+					count++
+				}
+			}
+			if count <= 1 {
+				Logger.Debug("single file, not grouped", "activity", folderPath)
+				continue
+			}
+		}
+
+		// Loop through the file references and assign the folder name
+		// to the corresponding files in the file mapping
+		for _, id := range fileIDs {
+			if file, exists := fileMapping[id]; exists {
+				file.Folder = folderName
+				fileMapping[id] = file
+				Logger.Debug("assigned folder", "id", id, "folder", folderName)
+			} else {
+				Logger.Debug("referenced file not in mapping", "id", id, "activity", folderPath)
+			}
+		}
+	}
+	return nil
+}
+
+// CourseFilesFolder is the folder of the files of the course itself (like the course image).
+const CourseFilesFolder = "Course files"
+
+// processCourseFiles assigns a folder to the files of the course and of the sections
+// (like the images of the course summary or of the section descriptions) that are not in an activity folder.
+// The files of the course are referenced by course/inforef.xml and go to CourseFilesFolder,
+// the files of a section are referenced by sections/section_ID/inforef.xml and go to the folder of the section.
+func processCourseFiles(source fs.FS, fileMapping map[string]File) error {
+	// assignFolder assigns the folder to the referenced files that have none
+	assignFolder := func(folderPath string, folderName string) {
+		fileIDs, err := readInforef(source, folderPath)
+		if err != nil {
+			// Not all backups have the course and section folders
+			Logger.Debug("no file references", "folder", folderPath, "error", err)
+			return
+		}
+		for _, id := range fileIDs {
+			if file, exists := fileMapping[id]; exists && file.Folder == "" {
+				file.Folder = folderName
+				fileMapping[id] = file
+				Logger.Debug("assigned folder", "id", id, "folder", folderName)
+			}
+		}
+	}
+
+	// The files of the course
+	assignFolder("course", CourseFilesFolder)
+
+	// The files of the sections
+	dirs, err := fs.ReadDir(source, "sections")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading sections folder: %w", err)
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() || !strings.HasPrefix(dir.Name(), "section_") {
+			continue
+		}
+		folderPath := path.Join("sections", dir.Name())
+
+		// Read the name of the section from the section.xml file
+		file, err := source.Open(path.Join(folderPath, "section.xml"))
+		if err != nil {
+			Logger.Warn("error reading the section", "section", folderPath, "error", err)
+			continue
+		}
+		var section struct {
+			Number string `xml:"number"`
+			Name   string `xml:"name"`
+		}
+		err = parseXMLFile(file, &section)
+		file.Close()
+		if err != nil {
+			Logger.Warn("error parsing the section", "section", folderPath, "error", err)
+			continue
+		}
+		// The sections without a custom name are named after their number
+		title := section.Name
+		if title == "" || title == "$@NULL@$" {
+			title = section.Number
+		}
+
+		assignFolder(folderPath, sectionFolderName(title))
+	}
+	return nil
+}
+
+// sectionFolderName returns the folder name for a course section.
+// Sections without a custom name use their number as title in moodle_backup.xml,
+// so they are named "General" (section 0) or "Topic N" like in the Moodle interface.
+func sectionFolderName(title string) string {
+	if n, err := strconv.Atoi(title); err == nil {
+		if n == 0 {
+			return "General"
+		}
+		return fmt.Sprintf("Topic %d", n)
+	}
+	return sanitizeFileName(title)
+}
+
+// processSections reads the course sections from moodle_backup.xml and updates the file mapping
+// with the section of the activity each file belongs to.
+// The moodle_backup.xml structure is like this:
+// ```xml
+// <moodle_backup>
+//
+//	<information>
+//		...
+//		<contents>
+//			<activities>
+//				<activity>
+//					<sectionid>1234</sectionid>
+//					<directory>activities/folder_5678</directory>
+//					...
+//				</activity>
+//				...
+//			</activities>
+//			<sections>
+//				<section>
+//					<sectionid>1234</sectionid>
+//					<title>Introduction</title>
+//					...
+//				</section>
+//				...
+//			</sections>
+//		</contents>
+//	</information>
+//
+// </moodle_backup>
+// ```
+func processSections(source fs.FS, fileMapping map[string]File) error {
+	// Open the moodle_backup.xml file
+	backupFile, err := source.Open("moodle_backup.xml")
+	if err != nil {
+		return fmt.Errorf("error reading moodle_backup.xml: %w", err)
+	}
+	defer backupFile.Close()
+
+	// Parse the moodle_backup.xml file to get the activities and the sections
+	var backupData struct {
+		Activities []struct {
+			SectionID string `xml:"sectionid"`
+			Directory string `xml:"directory"`
+		} `xml:"information>contents>activities>activity"`
+		Sections []struct {
+			SectionID string `xml:"sectionid"`
+			Title     string `xml:"title"`
+		} `xml:"information>contents>sections>section"`
+	}
+	if err := parseXMLFile(backupFile, &backupData); err != nil {
+		return fmt.Errorf("error parsing moodle_backup.xml: %w", err)
+	}
+
+	// Create a mapping of section IDs to section folder names
+	sectionNames := make(map[string]string)
+	for _, section := range backupData.Sections {
+		sectionNames[section.SectionID] = sectionFolderName(section.Title)
+		Logger.Debug("found section", "section", section.SectionID, "name", sectionNames[section.SectionID])
+	}
+
+	// Loop through the activities and assign the section name to their files
+	for _, activity := range backupData.Activities {
+		sectionName, exists := sectionNames[activity.SectionID]
+		if !exists || sectionName == "" {
+			Logger.Debug("section not found", "section", activity.SectionID, "activity", activity.Directory)
+			continue
+		}
+
+		// Read the file references of the activity
+		fileIDs, err := readInforef(source, activity.Directory)
+		if err != nil {
+			Logger.Warn("error reading the file references", "activity", activity.Directory, "error", err)
+			continue
+		}
+		for _, id := range fileIDs {
+			if file, exists := fileMapping[id]; exists {
+				file.Section = sectionName
+				fileMapping[id] = file
+				Logger.Debug("assigned section", "id", id, "section", sectionName)
+			}
+		}
+	}
+	return nil
+}
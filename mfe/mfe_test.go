@@ -0,0 +1,674 @@
+package mfe
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestMain(m *testing.M) {
+	// Keep the output of the tests readable, the tests that check the log records set their own logger
+	Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	os.Exit(m.Run())
+}
+
+// captureLogs sends the log records to the returned buffer until the end of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var logs bytes.Buffer
+	logger := Logger
+	Logger = slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	t.Cleanup(func() { Logger = logger })
+	return &logs
+}
+
+// testFile is a file of a test backup: its entry in files.xml and its content.
+type testFile struct {
+	ID       string
+	Filepath string // / if empty
+	Filename string
+	Content  string
+}
+
+// contentHash returns the content hash of a content, its SHA-1 like in Moodle.
+func contentHash(content string) string {
+	sum := sha1.Sum([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// xmlText escapes a text for an XML element.
+func xmlText(text string) string {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(text))
+	return escaped.String()
+}
+
+// newBackup returns a minimal backup with the given files: files.xml, their content in files/xy/xyz...
+// and an empty activities folder.
+func newBackup(files ...testFile) fstest.MapFS {
+	backup := fstest.MapFS{"activities": &fstest.MapFile{Mode: fs.ModeDir}}
+	var filesXML strings.Builder
+	filesXML.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<files>\n")
+	for _, file := range files {
+		hash := contentHash(file.Content)
+		fmt.Fprintf(&filesXML, "  <file id=%q>\n", file.ID)
+		fmt.Fprintf(&filesXML, "    <contenthash>%s</contenthash>\n", hash)
+		fmt.Fprintf(&filesXML, "    <component>mod_folder</component>\n    <filearea>content</filearea>\n")
+		fmt.Fprintf(&filesXML, "    <filepath>%s</filepath>\n", xmlText(cmp.Or(file.Filepath, "/")))
+		fmt.Fprintf(&filesXML, "    <filename>%s</filename>\n", xmlText(file.Filename))
+		fmt.Fprintf(&filesXML, "    <filesize>%d</filesize>\n", len(file.Content))
+		fmt.Fprintf(&filesXML, "  </file>\n")
+		backup[path.Join("files", hash[:2], hash)] = &fstest.MapFile{Data: []byte(file.Content)}
+	}
+	filesXML.WriteString("</files>\n")
+	backup["files.xml"] = &fstest.MapFile{Data: []byte(filesXML.String())}
+	return backup
+}
+
+// inforef returns an inforef.xml file that refers to the files with the given IDs.
+func inforef(ids ...string) *fstest.MapFile {
+	var refs strings.Builder
+	for _, id := range ids {
+		fmt.Fprintf(&refs, "<file><id>%s</id></file>", id)
+	}
+	return &fstest.MapFile{Data: []byte("<inforef><fileref>" + refs.String() + "</fileref></inforef>")}
+}
+
+// addActivity adds an activity (like activities/folder_1) with the given name, that refers to the files, to the backup.
+func addActivity(backup fstest.MapFS, activityPath string, name string, ids ...string) {
+	activityType, _, _ := strings.Cut(path.Base(activityPath), "_")
+	activityXML := fmt.Sprintf("<activity><%[1]s><name>%[2]s</name></%[1]s></activity>", activityType, xmlText(name))
+	backup[path.Join(activityPath, activityType+".xml")] = &fstest.MapFile{Data: []byte(activityXML)}
+	backup[path.Join(activityPath, "inforef.xml")] = inforef(ids...)
+}
+
+// addSection adds a section (like sections/section_1) with the given number and name, that refers to the files, to the backup.
+func addSection(backup fstest.MapFS, sectionPath string, number int, name string, ids ...string) {
+	sectionXML := fmt.Sprintf("<section><number>%d</number><name>%s</name></section>", number, xmlText(name))
+	backup[path.Join(sectionPath, "section.xml")] = &fstest.MapFile{Data: []byte(sectionXML)}
+	backup[path.Join(sectionPath, "inforef.xml")] = inforef(ids...)
+}
+
+// courseBackup returns the backup used by most tests: a folder activity with two files,
+// a resource with a single file, a course file, a section file and a file of no activity.
+func courseBackup() fstest.MapFS {
+	backup := newBackup(
+		testFile{ID: "1", Filename: "a.pdf", Content: "first"},
+		testFile{ID: "2", Filepath: "/week 1/", Filename: "b.txt", Content: "second"},
+		testFile{ID: "3", Filename: "single.pdf", Content: "third"},
+		testFile{ID: "4", Filename: "image.png", Content: "fourth"},
+		testFile{ID: "5", Filename: "summary.png", Content: "fifth"},
+		testFile{ID: "6", Filename: "loose.txt", Content: "sixth"},
+	)
+	addActivity(backup, "activities/folder_1", "Lecture notes", "1", "2")
+	addActivity(backup, "activities/resource_2", "Syllabus", "3")
+	backup["course/inforef.xml"] = inforef("4")
+	addSection(backup, "sections/section_1", 1, "$@NULL@$", "5")
+	return backup
+}
+
+// readTree returns the content of the files of a folder, by slash-separated path relative to it.
+func readTree(t *testing.T, folder string) map[string]string {
+	t.Helper()
+	tree := make(map[string]string)
+	err := filepath.WalkDir(folder, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(folder, filePath)
+		if err != nil {
+			return err
+		}
+		tree[filepath.ToSlash(relative)] = string(content)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("reading %s: %v", folder, err)
+	}
+	return tree
+}
+
+// assertTree checks that a folder contains exactly the expected files.
+func assertTree(t *testing.T, folder string, want map[string]string) {
+	t.Helper()
+	got := readTree(t, folder)
+	if !maps.Equal(got, want) {
+		t.Errorf("files of %s:\n got %v\nwant %v", folder, got, want)
+	}
+}
+
+func TestBuildFileMapping(t *testing.T) {
+	backup := newBackup(
+		testFile{ID: "1", Filename: "a.pdf", Content: "first"},
+		testFile{ID: "2", Filename: "a/b?.txt", Content: "second"},
+		// the entries of the folders are not files
+		testFile{ID: "3", Filepath: "/week 1/", Filename: ".", Content: ""},
+	)
+
+	fileMapping, err := buildFileMapping(backup, "files.xml", true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := slices.Sorted(maps.Keys(fileMapping)); !slices.Equal(ids, []string{"1", "2"}) {
+		t.Fatalf("got IDs %v, want [1 2]", ids)
+	}
+	file := fileMapping["2"]
+	if file.Filename != "a-b-.txt" || file.OriginalFilename != "a/b?.txt" {
+		t.Errorf("got filename %q (original %q), want \"a-b-.txt\" (original \"a/b?.txt\")", file.Filename, file.OriginalFilename)
+	}
+	if file.ContentHash != contentHash("second") || file.Filesize != int64(len("second")) || file.Filepath != "/" {
+		t.Errorf("got hash %s, size %d and filepath %q", file.ContentHash, file.Filesize, file.Filepath)
+	}
+}
+
+func TestBuildFileMappingNotBackup(t *testing.T) {
+	_, err := buildFileMapping(fstest.MapFS{}, "files.xml", true, false, false)
+	if !errors.Is(err, ErrNotBackup) {
+		t.Errorf("got error %v, want ErrNotBackup", err)
+	}
+}
+
+func TestProcessActivitiesFolder(t *testing.T) {
+	backup := courseBackup()
+	fileMapping, err := buildFileMapping(backup, "files.xml", true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := processActivitiesFolder(backup, "activities", fileMapping, DefaultActivityTypes); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		id       string
+		folder   string
+		activity string
+	}{
+		{"1", "Lecture notes", "activities/folder_1"},
+		{"2", "Lecture notes", "activities/folder_1"},
+		// a resource with a single file is not grouped
+		{"3", "", "activities/resource_2"},
+		{"4", "", ""},
+		{"6", "", ""},
+	}
+	for _, test := range tests {
+		file := fileMapping[test.id]
+		if file.Folder != test.folder || file.Activity != test.activity {
+			t.Errorf("file %s: got folder %q and activity %q, want %q and %q", test.id, file.Folder, file.Activity, test.folder, test.activity)
+		}
+	}
+}
+
+func TestProcessActivitiesFolderTypes(t *testing.T) {
+	backup := courseBackup()
+	fileMapping, err := buildFileMapping(backup, "files.xml", true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the activities of other types are ignored
+	if err := processActivitiesFolder(backup, "activities", fileMapping, []string{"resource"}); err != nil {
+		t.Fatal(err)
+	}
+	if file := fileMapping["1"]; file.Folder != "" || file.Activity != "" {
+		t.Errorf("got folder %q and activity %q for a file of an ignored activity", file.Folder, file.Activity)
+	}
+}
+
+func TestProcessCourseFiles(t *testing.T) {
+	backup := courseBackup()
+	addSection(backup, "sections/section_2", 2, "Exams", "6", "1")
+	fileMapping, err := buildFileMapping(backup, "files.xml", true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := processActivitiesFolder(backup, "activities", fileMapping, DefaultActivityTypes); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := processCourseFiles(backup, fileMapping); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"1": "Lecture notes", // the folder of the activity is kept
+		"3": "",
+		"4": CourseFilesFolder,
+		"5": "Topic 1", // the section without name is named after its number
+		"6": "Exams",
+	}
+	for id, folder := range want {
+		if got := fileMapping[id].Folder; got != folder {
+			t.Errorf("file %s: got folder %q, want %q", id, got, folder)
+		}
+	}
+}
+
+func TestProcessCourseFilesWithoutSections(t *testing.T) {
+	backup := newBackup(testFile{ID: "1", Filename: "a.pdf", Content: "first"})
+	fileMapping, err := buildFileMapping(backup, "files.xml", true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := processCourseFiles(backup, fileMapping); err != nil {
+		t.Errorf("got error %v for a backup without course and sections folders", err)
+	}
+}
+
+func TestCopyFiles(t *testing.T) {
+	backup := courseBackup()
+	destination := filepath.Join(t.TempDir(), "course")
+	opts := Options{Jobs: 2}
+	fileMapping, err := mapFiles(backup, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := copyFiles(context.Background(), backup, destination, fileMapping, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied != 6 || stats.Skipped != 0 || stats.Missing != 0 || stats.Failed != 0 {
+		t.Errorf("got stats %+v, want 6 copied files", stats)
+	}
+	assertTree(t, destination, map[string]string{
+		"Lecture notes/a.pdf":        "first",
+		"Lecture notes/week 1/b.txt": "second",
+		"single.pdf":                 "third",
+		"Course files/image.png":     "fourth",
+		"Topic 1/summary.png":        "fifth",
+		"loose.txt":                  "sixth",
+	})
+
+	// a second run skips the existing files
+	stats, err = copyFiles(context.Background(), backup, destination, fileMapping, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied != 0 || stats.Skipped != 6 {
+		t.Errorf("got stats %+v on the second run, want 6 skipped files", stats)
+	}
+}
+
+func TestCopyFilesMissing(t *testing.T) {
+	backup := courseBackup()
+	delete(backup, path.Join("files", contentHash("first")[:2], contentHash("first")))
+	destination := t.TempDir()
+	fileMapping, err := mapFiles(backup, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := copyFiles(context.Background(), backup, destination, fileMapping, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied != 5 || stats.Missing != 1 {
+		t.Errorf("got stats %+v, want 5 copied and 1 missing files", stats)
+	}
+	if _, err := os.Stat(filepath.Join(destination, "Lecture notes", "a.pdf")); err == nil {
+		t.Error("the missing file was created")
+	}
+}
+
+// BenchmarkExtract extracts a generated backup of 2000 files of 16 KiB in 20 folders,
+// sequentially and with a worker per CPU (at least 4, the copy is mostly I/O).
+func BenchmarkExtract(b *testing.B) {
+	var files []testFile
+	for i := range 2000 {
+		content := strings.Repeat(fmt.Sprintf("%08d", i), 2048)
+		files = append(files, testFile{ID: strconv.Itoa(i + 1), Filename: fmt.Sprintf("file %d.bin", i), Content: content})
+	}
+	backup := newBackup(files...)
+	for folder := range 20 {
+		var ids []string
+		for i := folder; i < len(files); i += 20 {
+			ids = append(ids, files[i].ID)
+		}
+		addActivity(backup, fmt.Sprintf("activities/folder_%d", folder+1), fmt.Sprintf("Folder %d", folder+1), ids...)
+	}
+
+	for _, jobs := range []int{1, max(runtime.NumCPU(), 4)} {
+		b.Run(fmt.Sprintf("jobs=%d", jobs), func(b *testing.B) {
+			b.SetBytes(int64(len(files) * len(files[0].Content)))
+			for b.Loop() {
+				destination := b.TempDir()
+				result, err := Extract(b.Context(), backup, destination, Options{Jobs: jobs})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if result.Copied != len(files) {
+					b.Fatalf("copied %d files, want %d", result.Copied, len(files))
+				}
+			}
+		})
+	}
+}
+
+func TestToASCII(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Ça a été l'élève", "Ca a ete l'eleve"},
+		{"Cœur à l'œuvre.pdf", "Coeur a l'oeuvre.pdf"},
+		{"Лекция 1 - Увод.pdf", "Lektsiya 1 - Uvod.pdf"},
+		{"Щастие и жълтица", "Shtastie i zhaltitsa"},
+		{"ascii only.txt", "ascii only.txt"},
+		{"日本.txt", "__.txt"},
+	}
+	for _, test := range tests {
+		if got := toASCII(test.name); got != test.want {
+			t.Errorf("toASCII(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCopyFilesASCII(t *testing.T) {
+	backup := newBackup(
+		testFile{ID: "1", Filename: "résumé.pdf", Content: "french"},
+		testFile{ID: "2", Filename: "Задача.txt", Content: "cyrillic"},
+	)
+	addActivity(backup, "activities/folder_1", "Упражнения", "1", "2")
+
+	// the default keeps the names
+	destination := t.TempDir()
+	if _, err := Extract(context.Background(), backup, destination, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	assertTree(t, destination, map[string]string{"Упражнения/résumé.pdf": "french", "Упражнения/Задача.txt": "cyrillic"})
+
+	destination = t.TempDir()
+	if _, err := Extract(context.Background(), backup, destination, Options{ASCII: true}); err != nil {
+		t.Fatal(err)
+	}
+	assertTree(t, destination, map[string]string{"Uprazhneniya/resume.pdf": "french", "Uprazhneniya/Zadacha.txt": "cyrillic"})
+}
+
+func TestExtractPathTraversal(t *testing.T) {
+	backup := newBackup(
+		testFile{ID: "1", Filepath: "/../../../", Filename: "../../escape.txt", Content: "escape"},
+		testFile{ID: "2", Filepath: "/../../etc/", Filename: "/etc/passwd", Content: "passwd"},
+		testFile{ID: "3", Filepath: "/../", Filename: "..", Content: "dots"},
+	)
+	addActivity(backup, "activities/folder_1", "..", "1", "3")
+	backup["moodle_backup.xml"] = &fstest.MapFile{Data: []byte(`<moodle_backup><information><contents>
+<activities><activity><sectionid>9</sectionid><directory>activities/folder_1</directory></activity></activities>
+<sections><section><sectionid>9</sectionid><title>..</title></section></sections>
+</contents></information></moodle_backup>`)}
+	root := t.TempDir()
+	destination := filepath.Join(root, "a", "b", "dest")
+	logs := captureLogs(t)
+
+	result, err := Extract(context.Background(), backup, destination, Options{Sections: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing is written outside of the destination
+	assertTree(t, root, map[string]string{"a/b/dest/etc/etc-passwd": "passwd"})
+	if result.Copied != 1 || result.Skipped != 2 {
+		t.Errorf("got %d copied and %d skipped files, want 1 and 2", result.Copied, result.Skipped)
+	}
+	if count := strings.Count(logs.String(), "skipped unsafe path"); count != 2 {
+		t.Errorf("got %d unsafe path warnings, want 2:\n%s", count, logs)
+	}
+}
+
+func TestValidateLooseFilesDir(t *testing.T) {
+	for _, dir := range []string{"..", ".", "/", "??"} {
+		if err := (Options{LooseFilesDir: dir}).Validate(); err == nil {
+			t.Errorf("--loose-files-dir %q is accepted", dir)
+		}
+	}
+	for _, dir := range []string{"", "_loose", "../loose"} {
+		if err := (Options{LooseFilesDir: dir}).Validate(); err != nil {
+			t.Errorf("--loose-files-dir %q is rejected: %v", dir, err)
+		}
+	}
+}
+
+func TestSanitizeFileNameWindows(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"CON", "_CON"},
+		{"con.txt", "_con.txt"},
+		{"Nul.tar.gz", "_Nul.tar.gz"},
+		{"COM1", "_COM1"},
+		{"lpt9.log", "_lpt9.log"},
+		{"AUX", "_AUX"},
+		{"prn.", "_prn"}, // the trailing dot is stripped first
+		// not reserved
+		{"CONSOLE.txt", "CONSOLE.txt"},
+		{"COM0", "COM0"},
+		{"my con.txt", "my con.txt"},
+		// the trailing dots and spaces are stripped by Windows
+		{"report. . ", "report"},
+		{"notes.txt...", "notes.txt"},
+		{" spaced ", "spaced"},
+	}
+	for _, test := range tests {
+		if got := sanitizeFileName(test.name); got != test.want {
+			t.Errorf("sanitizeFileName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"notes.pdf", "notes.pdf"},
+		{"a/b\\c.txt", "a-b-c.txt"},
+		{"what?.pdf", "what-.pdf"},
+		{"a <:> b.txt", "a - b.txt"}, // a run of invalid characters becomes a single hyphen
+		{"tab\there\x00.txt", "tab-here-.txt"},
+		{`"quoted" |pipe|*star*`, "quoted- -pipe-star"},
+		{"-leading and trailing-", "leading and trailing"},
+		{"???", ""}, // only invalid characters
+		{".", "."},  // the dot names are left to the callers
+		{"..", ".."},
+		{"été 2024", "été 2024"},
+	}
+	for _, test := range tests {
+		if got := sanitizeFileName(test.name); got != test.want {
+			t.Errorf("sanitizeFileName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// latin1 encodes the text in ISO-8859-1 (the text must have only the first 256 code points).
+func latin1(text string) []byte {
+	encoded := make([]byte, 0, len(text))
+	for _, r := range text {
+		encoded = append(encoded, byte(r))
+	}
+	return encoded
+}
+
+func TestExtractLatin1(t *testing.T) {
+	backup := newBackup(testFile{ID: "1", Filename: "résumé.pdf", Content: "first"})
+	hash := contentHash("first")
+	backup["files.xml"] = &fstest.MapFile{Data: latin1(`<?xml version="1.0" encoding="ISO-8859-1"?>
+<files><file id="1"><contenthash>` + hash + `</contenthash><filepath>/</filepath><filename>résumé.pdf</filename><filesize>5</filesize></file></files>`)}
+	backup["activities/folder_1/folder.xml"] = &fstest.MapFile{Data: latin1(`<?xml version="1.0" encoding="windows-1252"?>
+<activity><folder><name>Séance 1</name></folder></activity>`)}
+	backup["activities/folder_1/inforef.xml"] = inforef("1")
+
+	destination := t.TempDir()
+	if _, err := Extract(context.Background(), backup, destination, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	assertTree(t, destination, map[string]string{"Séance 1/résumé.pdf": "first"})
+}
+
+func TestReadFilesXMLUnsupportedEncoding(t *testing.T) {
+	backup := fstest.MapFS{"files.xml": &fstest.MapFile{Data: []byte(`<?xml version="1.0" encoding="x-unknown"?><files></files>`)}}
+	if _, err := readFilesXML(backup, "files.xml"); err == nil || !strings.Contains(err.Error(), "x-unknown") {
+		t.Errorf("got %v, want an unsupported encoding error", err)
+	}
+}
+
+func TestReadFilesXMLTruncated(t *testing.T) {
+	backup := newBackup(
+		testFile{ID: "1", Filename: "a.pdf", Content: "first"},
+		testFile{ID: "2", Filename: "b.pdf", Content: "second"},
+	)
+	// cut files.xml in the middle of the second file
+	filesXML := string(backup["files.xml"].Data)
+	backup["files.xml"].Data = []byte(filesXML[:strings.LastIndex(filesXML, "<filename>")])
+	logs := captureLogs(t)
+
+	files, err := readFilesXML(backup, "files.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Filename != "a.pdf" {
+		t.Errorf("got %v, want only a.pdf", files)
+	}
+	if !strings.Contains(logs.String(), "files.xml is malformed") {
+		t.Errorf("the truncated files.xml is not reported:\n%s", logs)
+	}
+
+	// nothing can be read before the malformed part
+	backup["files.xml"].Data = []byte("<files><file id=")
+	if _, err := readFilesXML(backup, "files.xml"); err == nil {
+		t.Error("a files.xml without any file must fail")
+	}
+}
+
+func TestExtractBeforeCopy(t *testing.T) {
+	destination := filepath.Join(t.TempDir(), "output")
+	cancelled := errors.New("cancelled")
+	var files int
+	var size int64
+	before := func(n int, bytes int64) error {
+		files, size = n, bytes
+		return cancelled
+	}
+
+	// nothing is written when the extraction is cancelled
+	_, err := Extract(context.Background(), courseBackup(), destination, Options{Exclude: []string{"*.png"}, BeforeCopy: before})
+	if !errors.Is(err, cancelled) {
+		t.Fatalf("got %v, want the error of BeforeCopy", err)
+	}
+	if files != 4 || size != int64(len("first")+len("second")+len("third")+len("sixth")) {
+		t.Errorf("got %d files and %d bytes, want the 4 files that are not excluded", files, size)
+	}
+	if _, err := os.Stat(destination); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("the destination was created: %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	backup := newBackup(
+		testFile{ID: "1", Filename: "a.pdf", Content: "first"},
+		testFile{ID: "2", Filename: "b.pdf", Content: "second"},
+		testFile{ID: "3", Filepath: "/week 1/", Filename: ".", Content: ""}, // a folder entry
+		testFile{ID: "4", Filename: ".DS_Store", Content: "junk"},
+	)
+	backup["moodle_backup.xml"] = &fstest.MapFile{Data: []byte("<moodle_backup/>")}
+	delete(backup, path.Join("files", contentHash("second")[:2], contentHash("second")))
+
+	result, err := Check(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// all the entries of files.xml are declared files, even the ones that are not extracted
+	if result.Files != 4 {
+		t.Errorf("got %d files declared, want 4", result.Files)
+	}
+	if len(result.MissingBlobs) != 1 || result.MissingBlobs[0].ID != "2" {
+		t.Errorf("got missing %v, want the file 2", result.MissingBlobs)
+	}
+	if result.Complete() {
+		t.Error("a backup with a missing content is complete")
+	}
+}
+
+func TestExtractOrphansFilters(t *testing.T) {
+	backup := newBackup(testFile{ID: "1", Filename: "a.pdf", Content: "first"})
+	orphan := contentHash("orphan")
+	backup[path.Join("files", orphan[:2], orphan)] = &fstest.MapFile{Data: []byte("orphan")}
+
+	tests := []struct {
+		name string
+		opts Options
+		want map[string]string
+	}{
+		{"all", Options{}, map[string]string{"a.pdf": "first", OrphansFolder + "/" + orphan: "orphan"}},
+		{"only-ids", Options{OnlyIDs: []string{"1"}}, map[string]string{"a.pdf": "first"}},
+		{"only-ids orphan", Options{OnlyIDs: []string{"orphan-" + orphan}}, map[string]string{OrphansFolder + "/" + orphan: "orphan"}},
+		{"only-names", Options{Include: []string{"*.pdf"}}, map[string]string{"a.pdf": "first"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			destination := t.TempDir()
+			test.opts.Orphans = true
+			if _, err := Extract(context.Background(), backup, destination, test.opts); err != nil {
+				t.Fatal(err)
+			}
+			assertTree(t, destination, test.want)
+		})
+	}
+}
+
+func TestExtractMalformedQuestions(t *testing.T) {
+	backup := courseBackup()
+	backup["questions.xml"] = &fstest.MapFile{Data: []byte("<question_categories><question_category id=\"1\"><name>Default")}
+	logs := captureLogs(t)
+
+	// the question bank is optional, the other files are still extracted
+	destination := t.TempDir()
+	result, err := Extract(context.Background(), backup, destination, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Copied != 6 {
+		t.Errorf("copied %d files, want 6", result.Copied)
+	}
+	if !strings.Contains(logs.String(), "error reading the question categories") {
+		t.Errorf("the malformed questions.xml is not reported:\n%s", logs)
+	}
+}
+
+func TestExtractByUserMalformedUsers(t *testing.T) {
+	backup := newBackup(testFile{ID: "1", Filename: "essay.pdf", Content: "essay"})
+	filesXML := strings.Replace(string(backup["files.xml"].Data), "<component>mod_folder</component>", "<component>assignsubmission_file</component><itemid>15</itemid>", 1)
+	backup["files.xml"].Data = []byte(filesXML)
+	backup["activities/assign_3/assign.xml"] = &fstest.MapFile{Data: []byte(`<activity><assign id="3"><name>Homework</name><submissions><submission id="15"><userid>42</userid></submission></submissions></assign></activity>`)}
+	backup["activities/assign_3/inforef.xml"] = inforef("1")
+	backup["users.xml"] = &fstest.MapFile{Data: []byte(`<users><user id="42"><username>jdoe`)}
+	logs := captureLogs(t)
+
+	// without the usernames, the submitted files are grouped by user ID
+	destination := t.TempDir()
+	if _, err := Extract(context.Background(), backup, destination, Options{ByUser: true}); err != nil {
+		t.Fatal(err)
+	}
+	assertTree(t, destination, map[string]string{"Homework/" + SubmissionsFolder + "/42/essay.pdf": "essay"})
+	if !strings.Contains(logs.String(), "error reading the users") {
+		t.Errorf("the malformed users.xml is not reported:\n%s", logs)
+	}
+}
@@ -0,0 +1,85 @@
+package mfe
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+)
+
+// OrphansFolder is the folder of the orphan blobs with Options.Orphans.
+const OrphansFolder = "_orphans"
+
+// Orphan is a blob of the files folder that no file of files.xml refers to.
+type Orphan struct {
+	Hash string // content hash of the blob (its name)
+	Path string // path of the blob in the source, like files/xy/xyz...
+	Size int64  // size of the blob in bytes
+}
+
+// Orphans returns the blobs of the files folder of the Moodle backup source that are not referenced
+// by any file of files.xml (including the system files and the folder entries), sorted by hash.
+// These blobs are not extracted, but may be the content of deleted files.
+func Orphans(source fs.FS) ([]Orphan, error) {
+	// The hashes referenced by files.xml, without any filtering
+	files, err := readFilesXML(source, "files.xml")
+	if err != nil {
+		return nil, err
+	}
+	referenced := make(map[string]bool, len(files))
+	for _, file := range files {
+		referenced[file.ContentHash] = true
+	}
+
+	// Walk the files folder, the blobs are named after their content hash
+	var orphans []Orphan
+	err = fs.WalkDir(source, "files", func(blobPath string, entry fs.DirEntry, err error) error {
+		// A backup without any file content has no files folder
+		if err != nil && blobPath == "files" && errors.Is(err, fs.ErrNotExist) {
+			return fs.SkipAll
+		}
+		if err != nil {
+			return err
+		}
+		hash := path.Base(blobPath)
+		if entry.IsDir() || !validContentHash.MatchString(hash) || referenced[hash] {
+			return nil
+		}
+		orphan := Orphan{Hash: hash, Path: blobPath}
+		if info, err := entry.Info(); err == nil {
+			orphan.Size = info.Size()
+		}
+		orphans = append(orphans, orphan)
+		Logger.Debug("orphan blob", "hash", hash, "size", orphan.Size)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading files folder: %w", err)
+	}
+
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].Hash < orphans[j].Hash
+	})
+	return orphans, nil
+}
+
+// addOrphans adds the orphan blobs to the file mapping, as files named after their hash in OrphansFolder.
+func addOrphans(source fs.FS, fileMapping map[string]File) error {
+	orphans, err := Orphans(source)
+	if err != nil {
+		return err
+	}
+	for _, orphan := range orphans {
+		id := "orphan-" + orphan.Hash
+		fileMapping[id] = File{
+			ID:               id,
+			ContentHash:      orphan.Hash,
+			Filename:         orphan.Hash,
+			OriginalFilename: orphan.Hash,
+			Filesize:         orphan.Size,
+			Folder:           OrphansFolder,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package mfe
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// QuestionBankFolder is the folder of the files of the questions (like the images of a question text),
+// grouped by question category.
+const QuestionBankFolder = "Question bank"
+
+// questionCategories are the categories of the questions and of their answers, by ID.
+type questionCategories struct {
+	questions map[string]string
+	answers   map[string]string
+}
+
+// readQuestionCategories reads the category of each question and answer from the questions.xml file.
+// The questions are nested in their category, directly or in the question bank entries (Moodle 4):
+// ```xml
+// <question_categories>
+//
+//	<question_category id="1">
+//		<name>Default for Course</name>
+//		...
+//		<question id="5">
+//			...
+//			<answer id="12">...</answer>
+//		</question>
+//	</question_category>
+//
+// </question_categories>
+// ```
+func readQuestionCategories(source fs.FS) (questionCategories, error) {
+	categories := questionCategories{questions: make(map[string]string), answers: make(map[string]string)}
+
+	// Open the questions.xml file, the backups without questions may have none
+	questionsFile, err := source.Open("questions.xml")
+	if errors.Is(err, fs.ErrNotExist) {
+		return categories, nil
+	}
+	if err != nil {
+		return categories, fmt.Errorf("error opening questions.xml: %w", err)
+	}
+	defer questionsFile.Close()
+
+	// Walk the elements, remembering the name of the current category
+	decoder := newXMLDecoder(questionsFile)
+	var category string
+	var stack []string
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return categories, nil
+		}
+		if err != nil {
+			return categories, fmt.Errorf("error parsing questions.xml at byte %d: %w", decoder.InputOffset(), err)
+		}
+
+		switch element := token.(type) {
+		case xml.StartElement:
+			id := attribute(element, "id")
+			switch {
+			case element.Name.Local == "name" && len(stack) > 0 && stack[len(stack)-1] == "question_category":
+				// The name of the category, before its questions
+				var name string
+				if err := decoder.DecodeElement(&name, &element); err != nil {
+					return categories, fmt.Errorf("error parsing questions.xml at byte %d: %w", decoder.InputOffset(), err)
+				}
+				category = name
+				continue
+			case element.Name.Local == "question_category":
+				category = ""
+			case element.Name.Local == "question" && id != "":
+				categories.questions[id] = category
+			case element.Name.Local == "answer" && id != "":
+				categories.answers[id] = category
+			}
+			stack = append(stack, element.Name.Local)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+}
+
+// attribute returns the value of an attribute of an XML element, or an empty string.
+func attribute(element xml.StartElement, name string) string {
+	for _, attr := range element.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+// processQuestions assigns the folder Question bank/<category> to the files of the questions
+// that are not in another folder. The item ID of a question file is the ID of its question,
+// or of its answer for the answer and answerfeedback file areas.
+// A questions.xml that cannot be read is reported, and the files of the questions are not grouped.
+func processQuestions(source fs.FS, fileMapping map[string]File) {
+	categories, err := readQuestionCategories(source)
+	if err != nil {
+		Logger.Warn("error reading the question categories, the question files are not grouped", "error", err)
+		return
+	}
+	if len(categories.questions) == 0 {
+		return
+	}
+
+	for id, file := range fileMapping {
+		if file.Folder != "" || (file.Component != "question" && !strings.HasPrefix(file.Component, "qtype_")) {
+			continue
+		}
+		owners := categories.questions
+		if file.Filearea == "answer" || file.Filearea == "answerfeedback" {
+			owners = categories.answers
+		}
+		category, ok := owners[file.Itemid]
+		if !ok {
+			Logger.Debug("question of the file not found", "id", id, "itemid", file.Itemid, "filearea", file.Filearea)
+			continue
+		}
+		file.Folder = path.Join(QuestionBankFolder, sanitizeFileName(category))
+		fileMapping[id] = file
+		Logger.Debug("assigned folder", "id", id, "folder", file.Folder)
+	}
+}
@@ -0,0 +1,448 @@
+package mfe
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/nlepage/go-tarfs"
+	"github.com/ulikunitz/xz"
+)
+
+// CloseFunc is a function type used to return a function that closes resources.
+type CloseFunc func() error
+
+// decompressor returns a reader of the decompressed content of r.
+// The returned reader is closed by the close function of the filesystem if it's an io.Closer.
+type decompressor func(r io.Reader) (io.Reader, error)
+
+// SourceOptions are the settings of the opening of a source, see GetSource and SourceFromReader.
+// The zero value finds the backup in the source, decompresses the archives in memory,
+// and keeps the temporary files in the default folder of the system.
+type SourceOptions struct {
+	Root        string        // folder of the backup inside the source (like backup for backup/files.xml), found by backupRoot if empty
+	SpoolToDisk bool          // decompress the compressed tar archives to a temporary file instead of memory
+	TempDir     string        // folder of the temporary files (the spooled stdin, downloads and decompressed archives), os.TempDir if empty
+	HTTPTimeout time.Duration // time limit of the download of a source URL (no limit if 0)
+}
+
+// compressedTarFS creates a tar filesystem from a compressed tar file,
+// the decompress function supplies the decompressing reader.
+//
+// Memory: the tar filesystem needs random access to the entries, so by default the whole
+// decompressed tar is read in memory (the XML files are then parsed with a streaming decoder).
+// For very large backups, SpoolToDisk decompresses the tar to a temporary file instead,
+// and only the index of the entries is kept in memory.
+func (opts SourceOptions) compressedTarFS(tarPath string, decompress decompressor) (fs.FS, CloseFunc, error) {
+	// Open the compressed tar file
+	file, err := os.Open(tarPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Create a tar filesystem from the file content
+	tarFs, closeTar, err := opts.decompressedTarFS(file, decompress)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	// Define the close function to return
+	close := func() error {
+		errt := closeTar()
+		errf := file.Close()
+		return errors.Join(errt, errf)
+	}
+
+	// Return the tar filesystem and a function to close the file
+	return tarFs, close, nil
+}
+
+// decompressedTarFS creates a tar filesystem from a compressed tar stream,
+// the decompress function supplies the decompressing reader.
+// The returned close function closes the decompressing reader (or removes the spooled tar),
+// but not r.
+func (opts SourceOptions) decompressedTarFS(r io.Reader, decompress decompressor) (fs.FS, CloseFunc, error) {
+	// Create a decompressing reader
+	reader, err := decompress(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Define the close function to return
+	close := func() error {
+		if closer, ok := reader.(io.Closer); ok {
+			return closer.Close()
+		}
+		return nil
+	}
+
+	// Decompress to a temporary file, it is not kept in memory by tarfs as it's an io.ReaderAt
+	if opts.SpoolToDisk {
+		defer close()
+		return opts.spooledTarFS(reader)
+	}
+
+	// Create a tar filesystem from the decompressing reader
+	tarFs, err := tarfs.New(reader)
+	if err != nil {
+		close()
+		return nil, nil, err
+	}
+
+	return tarFs, close, nil
+}
+
+// spooledTarFS creates a tar filesystem from a tar stream spooled to a temporary file.
+// The returned close function closes and removes the temporary file.
+func (opts SourceOptions) spooledTarFS(reader io.Reader) (fs.FS, CloseFunc, error) {
+	// Spool the tar to a temporary file
+	tmpFile, err := os.CreateTemp(opts.TempDir, "mfe-*.tar")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating temporary file: %w", err)
+	}
+	Logger.Debug("decompressing to temporary file", "path", tmpFile.Name())
+	close := func() error {
+		errf := tmpFile.Close()
+		errr := os.Remove(tmpFile.Name())
+		return errors.Join(errf, errr)
+	}
+	if _, err := io.Copy(tmpFile, reader); err != nil {
+		close()
+		return nil, nil, fmt.Errorf("error decompressing to temporary file: %w", err)
+	}
+	if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+		close()
+		return nil, nil, err
+	}
+
+	// Create a tar filesystem from the temporary file
+	tarFs, err := tarfs.New(tmpFile)
+	if err != nil {
+		close()
+		return nil, nil, err
+	}
+	return tarFs, close, nil
+}
+
+// gunzip, bunzip2 and unxz are the decompressors of the .tar.gz, .tar.bz2 and .tar.xz archives.
+// The gzip reader reads all the members of a multi-stream file (concatenated gzip streams,
+// as written by some tools) as a single stream, so the tar spanning several members is read entirely.
+func gunzip(r io.Reader) (io.Reader, error) {
+	reader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	reader.Multistream(true)
+	return reader, nil
+}
+
+func bunzip2(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r), nil }
+
+func unxz(r io.Reader) (io.Reader, error) { return xz.NewReader(r) }
+
+// targzFS creates a tar filesystem from a .tar.gz file.
+// A .tar.gz file made of several concatenated gzip streams is read as a single tar archive.
+func (opts SourceOptions) targzFS(tarPath string) (fs.FS, CloseFunc, error) {
+	return opts.compressedTarFS(tarPath, gunzip)
+}
+
+// tarbz2FS creates a tar filesystem from a .tar.bz2 file.
+func (opts SourceOptions) tarbz2FS(tarPath string) (fs.FS, CloseFunc, error) {
+	return opts.compressedTarFS(tarPath, bunzip2)
+}
+
+// tarxzFS creates a tar filesystem from a .tar.xz file.
+func (opts SourceOptions) tarxzFS(tarPath string) (fs.FS, CloseFunc, error) {
+	return opts.compressedTarFS(tarPath, unxz)
+}
+
+// zipFS creates a zip filesystem from a .zip file.
+func zipFS(zipPath string) (fs.FS, CloseFunc, error) {
+	// Open the .zip file
+	file, err := os.Open(zipPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The zip reader needs the size of the file
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	// Create a zip filesystem from the file
+	zipFs, err := zip.NewReader(file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	// Return the zip filesystem and a function to close the file
+	return zipFs, file.Close, nil
+}
+
+// magic numbers used to detect the archive format of a .mbz file (or .tar.bz2, .tbz2, .tar.xz, .txz)
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	zipMagic   = []byte{'P', 'K', 0x03, 0x04}
+	bzip2Magic = []byte{'B', 'Z', 'h'}
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// sniffArchive reads the first bytes of a file and returns the matching archive backend.
+// It returns nil if the format is not recognized.
+func (opts SourceOptions) sniffArchive(filePath string) (func(string) (fs.FS, CloseFunc, error), error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Read the magic bytes (a short read is fine, the file may be tiny)
+	header := make([]byte, len(xzMagic))
+	n, err := io.ReadFull(file, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return opts.targzFS, nil
+	case bytes.HasPrefix(header, zipMagic):
+		return zipFS, nil
+	case bytes.HasPrefix(header, bzip2Magic):
+		return opts.tarbz2FS, nil
+	case bytes.HasPrefix(header, xzMagic):
+		return opts.tarxzFS, nil
+	}
+	return nil, nil
+}
+
+// SourceFromReader creates the source filesystem from a .mbz file (or .tar.bz2, .tar.xz archive)
+// read from r, for example an uploaded backup kept in memory.
+// A .mbz file that is a zip archive is read entirely in memory, as the zip reader needs random access.
+// The returned close function drops the cached XML files of the source, but does not close r.
+func SourceFromReader(r io.Reader, opts SourceOptions) (fs.FS, CloseFunc, error) {
+	// Peek the magic bytes (a short read is fine, the content may be tiny)
+	reader := bufio.NewReader(r)
+	header, err := reader.Peek(len(xzMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, nil, fmt.Errorf("error reading source: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return opts.rooted(opts.decompressedTarFS(reader, gunzip))
+	case bytes.HasPrefix(header, bzip2Magic):
+		return opts.rooted(opts.decompressedTarFS(reader, bunzip2))
+	case bytes.HasPrefix(header, xzMagic):
+		return opts.rooted(opts.decompressedTarFS(reader, unxz))
+	case bytes.HasPrefix(header, zipMagic):
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading source: %w", err)
+		}
+		zipFs, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+		if err != nil {
+			return nil, nil, err
+		}
+		return opts.rooted(zipFs, nil, nil)
+	}
+	return nil, nil, fmt.Errorf("%w: not a .mbz file (gzip or zip), .tar.bz2 or .tar.xz archive", ErrUnsupportedSource)
+}
+
+// dirFS creates a filesystem interface for the specified directory.
+func dirFS(dirPath string) (fs.FS, CloseFunc, error) {
+	// Use os.DirFS to create a filesystem interface for the directory
+	dirFs := os.DirFS(dirPath)
+
+	return dirFs, nil, nil
+}
+
+// stdinFS creates a filesystem from a .mbz file read from stdin.
+// Note that stdin can only be a .mbz file, not an extracted folder.
+func (opts SourceOptions) stdinFS() (fs.FS, CloseFunc, error) {
+	return opts.spooledArchiveFS(os.Stdin, "stdin")
+}
+
+// urlFS creates a filesystem from a .mbz file downloaded from an http:// or https:// URL.
+// The redirects are followed.
+func (opts SourceOptions) urlFS(url string) (fs.FS, CloseFunc, error) {
+	client := &http.Client{Timeout: opts.HTTPTimeout}
+	response, err := client.Get(url)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error downloading source: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone {
+		return nil, nil, fmt.Errorf("error downloading source: %w: %s", ErrSourceNotFound, response.Status)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("error downloading source: %s", response.Status)
+	}
+	Logger.Info("downloading", "url", url, "size", response.ContentLength)
+	return opts.spooledArchiveFS(response.Body, "the download")
+}
+
+// spooledArchiveFS creates a filesystem from a .mbz file read from reader (named what in the errors).
+// As the archive backends need to seek, the reader is spooled to a temporary file
+// that is removed by the returned close function.
+func (opts SourceOptions) spooledArchiveFS(reader io.Reader, what string) (fs.FS, CloseFunc, error) {
+	// Spool the reader to a temporary file
+	tmpFile, err := os.CreateTemp(opts.TempDir, "mfe-*.mbz")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error creating temporary file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+	Logger.Debug("spooling to temporary file", "source", what, "path", tmpPath)
+	_, errCopy := io.Copy(tmpFile, reader)
+	errClose := tmpFile.Close()
+	if err := errors.Join(errCopy, errClose); err != nil {
+		os.Remove(tmpPath)
+		return nil, nil, fmt.Errorf("error reading %s: %w", what, err)
+	}
+
+	// Open the spooled file with the matching archive backend
+	archiveFS, err := opts.sniffArchive(tmpPath)
+	if err == nil && archiveFS == nil {
+		err = fmt.Errorf("%w: %s is not a .mbz file (gzip or zip)", ErrUnsupportedSource, what)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, nil, err
+	}
+	archive, closeArchive, err := archiveFS(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return nil, nil, err
+	}
+
+	// Define the close function to return, the file must be closed before being removed
+	close := func() error {
+		errArchive := closeArchive()
+		errRemove := os.Remove(tmpPath)
+		return errors.Join(errArchive, errRemove)
+	}
+
+	return archive, close, nil
+}
+
+// backupRoot returns the folder of the source that contains files.xml: the source itself,
+// or its single top folder for the archives that wrap the backup in a folder.
+// Note that the "./" prefix of the entries (like in an archive made with `tar czf backup.mbz ./`)
+// is already removed by the tar and zip filesystems.
+func backupRoot(source fs.FS) fs.FS {
+	if _, err := fs.Stat(source, "files.xml"); err == nil {
+		return source
+	}
+
+	// Look for files.xml in the single top folder
+	entries, err := fs.ReadDir(source, ".")
+	if err != nil || len(entries) != 1 || !entries[0].IsDir() {
+		return source
+	}
+	folder := entries[0].Name()
+	if _, err := fs.Stat(source, path.Join(folder, "files.xml")); err != nil {
+		return source
+	}
+	sub, err := fs.Sub(source, folder)
+	if err != nil {
+		return source
+	}
+	Logger.Debug("backup in a top folder", "folder", folder)
+	return sub
+}
+
+// rooted returns the backup root of a source returned by one of the backends:
+// the Root folder if set, or else the top of the source or its single top folder (see backupRoot).
+// Closing the source also drops its cached XML files, and in debug mode the accesses are logged (see tracedFS).
+func (opts SourceOptions) rooted(source fs.FS, close CloseFunc, err error) (fs.FS, CloseFunc, error) {
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.Root == "" {
+		root := traced(backupRoot(source))
+		return root, forgetting(root, close), nil
+	}
+
+	// Use the given folder of the source
+	root := path.Clean(strings.Trim(opts.Root, "/"))
+	sub, err := fs.Sub(source, root)
+	if err == nil {
+		_, err = fs.Stat(sub, ".")
+	}
+	if err != nil {
+		if close != nil {
+			close()
+		}
+		return nil, nil, fmt.Errorf("invalid source root %q: %w", opts.Root, err)
+	}
+	traceable := traced(sub)
+	return traceable, forgetting(traceable, close), nil
+}
+
+// forgetting returns a close function that also drops the cached XML files of the source,
+// so that the cache does not keep a closed source (like a decompressed archive) in memory.
+// It is never nil, as a source without resources to close (like a zip read in memory) may still be cached.
+func forgetting(source fs.FS, close CloseFunc) CloseFunc {
+	return func() error {
+		parsedFiles.forget(source)
+		if close == nil {
+			return nil
+		}
+		return close()
+	}
+}
+
+// GetSource returns the source filesystem based on the provided path.
+// It checks if the path is a directory or a tar.gz file and returns the appropriate fs.FS.
+// The path "-" reads a .mbz file from stdin, and an http:// or https:// URL downloads a .mbz file.
+// The settings of opts only apply to this source, so several sources can be opened concurrently with different settings.
+func GetSource(sourcePath string, opts SourceOptions) (fs.FS, CloseFunc, error) {
+	// read the .mbz file from stdin
+	if sourcePath == "-" {
+		return opts.rooted(opts.stdinFS())
+	}
+	// download the .mbz file
+	if strings.HasPrefix(sourcePath, "http://") || strings.HasPrefix(sourcePath, "https://") {
+		return opts.rooted(opts.urlFS(sourcePath))
+	}
+
+	// Check if the source path exists
+	info, err := os.Stat(sourcePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("%w: %w", ErrSourceNotFound, err)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("error checking source path: %w", err)
+	}
+	// check if the source path is a directory
+	if info.IsDir() {
+		return opts.rooted(dirFS(sourcePath))
+	}
+	// check if it's a .mbz file (gzip or zip archive) or a .tar.bz2/.tar.xz archive
+	// by its content, not its extension
+	archiveFS, err := opts.sniffArchive(sourcePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading source file: %w", err)
+	}
+	if archiveFS != nil {
+		return opts.rooted(archiveFS(sourcePath))
+	}
+
+	return nil, nil, fmt.Errorf("%w: only folder, .mbz file (gzip or zip), .tar.bz2 and .tar.xz are supported: %s", ErrUnsupportedSource, sourcePath)
+}
@@ -0,0 +1,300 @@
+package mfe
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"testing/fstest"
+)
+
+// writeZip writes the files of a backup to a zip archive, with the given prefix (like ./) before each path,
+// and returns the path of the archive.
+func writeZip(t *testing.T, backup fstest.MapFS, name string, prefix string) string {
+	t.Helper()
+	archivePath := filepath.Join(t.TempDir(), name)
+	file, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := zip.NewWriter(file)
+	for _, entryPath := range slices.Sorted(maps.Keys(backup)) {
+		if backup[entryPath].Mode.IsDir() {
+			continue
+		}
+		entry, err := writer.Create(prefix + entryPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := entry.Write(backup[entryPath].Data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archivePath
+}
+
+// openSource opens a source with GetSource and closes it at the end of the test.
+func openSource(t *testing.T, sourcePath string) fs.FS {
+	t.Helper()
+	source, close, err := GetSource(sourcePath, SourceOptions{})
+	if err != nil {
+		t.Fatalf("opening %s: %v", sourcePath, err)
+	}
+	if close != nil {
+		t.Cleanup(func() {
+			if err := close(); err != nil {
+				t.Errorf("closing %s: %v", sourcePath, err)
+			}
+		})
+	}
+	return source
+}
+
+// listedPaths returns the paths of the files listed in a source with the default options.
+func listedPaths(t *testing.T, source fs.FS) []string {
+	t.Helper()
+	entries, err := List(source, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, entry := range entries {
+		paths = append(paths, entry.Path)
+	}
+	return paths
+}
+
+// courseBackupPaths are the paths of the files of courseBackup, in the listing order.
+var courseBackupPaths = []string{
+	"loose.txt",
+	"single.pdf",
+	"Course files/image.png",
+	"Lecture notes/a.pdf",
+	"Lecture notes/week 1/b.txt",
+	"Topic 1/summary.png",
+}
+
+func TestGetSourceZip(t *testing.T) {
+	// the .mbz extension is not trusted, the zip is detected by its content
+	archivePath := writeZip(t, courseBackup(), "backup.mbz", "")
+
+	source := openSource(t, archivePath)
+	if paths := listedPaths(t, source); !slices.Equal(paths, courseBackupPaths) {
+		t.Errorf("got files %v, want %v", paths, courseBackupPaths)
+	}
+
+	// the content is read from the zip
+	destination := t.TempDir()
+	if _, err := Extract(t.Context(), source, destination, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := os.ReadFile(filepath.Join(destination, "Lecture notes", "a.pdf")); err != nil || string(content) != "first" {
+		t.Errorf("got content %q (%v), want \"first\"", content, err)
+	}
+}
+
+func TestGetSourceUnsupported(t *testing.T) {
+	sourcePath := filepath.Join(t.TempDir(), "backup.mbz")
+	if err := os.WriteFile(sourcePath, []byte("not an archive"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := GetSource(sourcePath, SourceOptions{}); !errors.Is(err, ErrUnsupportedSource) {
+		t.Errorf("got error %v, want ErrUnsupportedSource", err)
+	}
+	if _, _, err := GetSource(filepath.Join(t.TempDir(), "missing.mbz"), SourceOptions{}); !errors.Is(err, ErrSourceNotFound) {
+		t.Errorf("got error %v, want ErrSourceNotFound", err)
+	}
+}
+
+// tarBackup returns the files of a backup as a tar archive, with the given prefix (like ./) before each path.
+func tarBackup(t *testing.T, backup fstest.MapFS, prefix string) []byte {
+	t.Helper()
+	var archive bytes.Buffer
+	writer := tar.NewWriter(&archive)
+	for _, entryPath := range slices.Sorted(maps.Keys(backup)) {
+		if backup[entryPath].Mode.IsDir() {
+			continue
+		}
+		data := backup[entryPath].Data
+		if err := writer.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: prefix + entryPath, Mode: 0o644, Size: int64(len(data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+// gzipped returns the data compressed as a gzip stream.
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return compressed.Bytes()
+}
+
+func TestSourceFromReader(t *testing.T) {
+	buffer := bytes.NewBuffer(gzipped(t, tarBackup(t, courseBackup(), "")))
+
+	source, close, err := SourceFromReader(buffer, SourceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if close != nil {
+		defer close()
+	}
+	if paths := listedPaths(t, source); !slices.Equal(paths, courseBackupPaths) {
+		t.Errorf("got files %v, want %v", paths, courseBackupPaths)
+	}
+}
+
+func TestSourceFromReaderUnsupported(t *testing.T) {
+	if _, _, err := SourceFromReader(bytes.NewBufferString("not an archive"), SourceOptions{}); !errors.Is(err, ErrUnsupportedSource) {
+		t.Errorf("got error %v, want ErrUnsupportedSource", err)
+	}
+}
+
+func TestSourceFromReaderZipForget(t *testing.T) {
+	data, err := os.ReadFile(writeZip(t, courseBackup(), "backup.mbz", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the zip read in memory is cached by the listing, and dropped from the cache when closed
+	source, close, err := SourceFromReader(bytes.NewReader(data), SourceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListFiles(source); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := parsedFiles.load(source, "files.xml"); !ok {
+		t.Fatal("the files of the zip source are not cached")
+	}
+	if close == nil {
+		t.Fatal("no close function for the zip source")
+	}
+	if err := close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := parsedFiles.load(source, "files.xml"); ok {
+		t.Error("the files of the closed zip source are still cached")
+	}
+}
+
+func TestGetSourceDotPrefix(t *testing.T) {
+	// like an archive made with `tar czf backup.mbz ./`
+	tarPath := filepath.Join(t.TempDir(), "backup.mbz")
+	if err := os.WriteFile(tarPath, gzipped(t, tarBackup(t, courseBackup(), "./")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	zipPath := writeZip(t, courseBackup(), "backup.mbz", "./")
+
+	for _, sourcePath := range []string{tarPath, zipPath} {
+		source := openSource(t, sourcePath)
+		if paths := listedPaths(t, source); !slices.Equal(paths, courseBackupPaths) {
+			t.Errorf("%s: got files %v, want %v", sourcePath, paths, courseBackupPaths)
+		}
+	}
+}
+
+func TestGetSourceMultistreamGzip(t *testing.T) {
+	// the tar is split in two concatenated gzip streams, in the middle of an entry
+	archive := tarBackup(t, courseBackup(), "")
+	half := len(archive)/2 + 7
+	data := append(gzipped(t, archive[:half]), gzipped(t, archive[half:])...)
+
+	tarPath := filepath.Join(t.TempDir(), "backup.mbz")
+	if err := os.WriteFile(tarPath, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if paths := listedPaths(t, openSource(t, tarPath)); !slices.Equal(paths, courseBackupPaths) {
+		t.Errorf("got files %v, want %v", paths, courseBackupPaths)
+	}
+
+	source, close, err := SourceFromReader(bytes.NewReader(data), SourceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if close != nil {
+		defer close()
+	}
+	if paths := listedPaths(t, source); !slices.Equal(paths, courseBackupPaths) {
+		t.Errorf("got files %v from a reader, want %v", paths, courseBackupPaths)
+	}
+}
+
+// assertTempFiles checks the number of files in the temporary folder.
+func assertTempFiles(t *testing.T, folder string, want int) {
+	t.Helper()
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != want {
+		t.Errorf("got %d temporary files in %s, want %d", len(entries), folder, want)
+	}
+}
+
+func TestTempDir(t *testing.T) {
+	folder := t.TempDir()
+	opts := SourceOptions{TempDir: folder}
+	data := gzipped(t, tarBackup(t, courseBackup(), ""))
+
+	// a spooled .mbz (like stdin or a download) is in TempDir until the source is closed
+	source, close, err := opts.spooledArchiveFS(bytes.NewReader(data), "the test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths := listedPaths(t, source); !slices.Equal(paths, courseBackupPaths) {
+		t.Errorf("got files %v, want %v", paths, courseBackupPaths)
+	}
+	assertTempFiles(t, folder, 1)
+	if err := close(); err != nil {
+		t.Fatal(err)
+	}
+	assertTempFiles(t, folder, 0)
+
+	// and it is removed at once if it is not a .mbz file
+	if _, _, err := opts.spooledArchiveFS(bytes.NewBufferString("not an archive"), "the test"); !errors.Is(err, ErrUnsupportedSource) {
+		t.Errorf("got error %v, want ErrUnsupportedSource", err)
+	}
+	assertTempFiles(t, folder, 0)
+
+	// the same for a tar decompressed to the disk
+	opts.SpoolToDisk = true
+	source, close, err = SourceFromReader(bytes.NewReader(data), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTempFiles(t, folder, 1)
+	if err := close(); err != nil {
+		t.Fatal(err)
+	}
+	assertTempFiles(t, folder, 0)
+	if _, _, err := SourceFromReader(bytes.NewReader(gzipped(t, []byte("not a tar"))), opts); err == nil {
+		t.Error("a gzip file without tar was read")
+	}
+	assertTempFiles(t, folder, 0)
+}
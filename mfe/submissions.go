@@ -0,0 +1,174 @@
+package mfe
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// SubmissionsFolder is the folder of the submitted files in the folder of an assignment, with --by-user.
+const SubmissionsFolder = "Submissions"
+
+// readUsers reads the usernames from the users.xml file, by user ID.
+// The backups made without the users have no users.xml, and an empty map is returned.
+// The users.xml structure is like this:
+// ```xml
+// <users>
+//
+//	<user id="42" contextid="123">
+//		<username>jdoe</username>
+//		...
+//	</user>
+//	...
+//
+// </users>
+// ```
+func readUsers(source fs.FS) (map[string]string, error) {
+	usernames := make(map[string]string)
+
+	// Open the users.xml file
+	usersFile, err := source.Open("users.xml")
+	if errors.Is(err, fs.ErrNotExist) {
+		return usernames, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening users.xml: %w", err)
+	}
+	defer usersFile.Close()
+
+	// Parse the users.xml file
+	var usersData struct {
+		Users []struct {
+			ID       string `xml:"id,attr"`
+			Username string `xml:"username"`
+		} `xml:"user"`
+	}
+	if err := parseXMLFile(usersFile, &usersData); err != nil {
+		return nil, fmt.Errorf("error parsing users.xml: %w", err)
+	}
+
+	for _, user := range usersData.Users {
+		if user.Username != "" {
+			usernames[user.ID] = user.Username
+		}
+	}
+	return usernames, nil
+}
+
+// readSubmissions reads the name of the assignment and the user ID of each submission
+// (by submission ID) from the assign.xml file of the assignment.
+// The assign.xml structure is like this:
+// ```xml
+// <activity>
+//
+//	<assign id="7">
+//		<name>Homework 1</name>
+//		<submissions>
+//			<submission id="15">
+//				<userid>42</userid>
+//				...
+//			</submission>
+//		</submissions>
+//		...
+//	</assign>
+//
+// </activity>
+// ```
+func readSubmissions(source fs.FS, activityPath string) (string, map[string]string, error) {
+	// Open the assign.xml file
+	assignXMLPath := path.Join(activityPath, "assign.xml")
+	assignFile, err := source.Open(assignXMLPath)
+	if err != nil {
+		return "", nil, fmt.Errorf("assign.xml not found in %s", activityPath)
+	}
+	defer assignFile.Close()
+
+	// Parse the assign.xml file
+	var assignData struct {
+		Assign struct {
+			Name        string `xml:"name"`
+			Submissions []struct {
+				ID     string `xml:"id,attr"`
+				Userid string `xml:"userid"`
+			} `xml:"submissions>submission"`
+		} `xml:"assign"`
+	}
+	if err := parseXMLFile(assignFile, &assignData); err != nil {
+		return "", nil, fmt.Errorf("error parsing %s: %w", assignXMLPath, err)
+	}
+
+	users := make(map[string]string, len(assignData.Assign.Submissions))
+	for _, submission := range assignData.Assign.Submissions {
+		users[submission.ID] = submission.Userid
+	}
+	return assignData.Assign.Name, users, nil
+}
+
+// processSubmissions groups the files submitted to the assignments by user,
+// in the folder <assignment>/Submissions/<username> (or the user ID if the username is unknown).
+// The submitted files (of the assignsubmission_* components) are referenced by the inforef.xml
+// of the assignment, and their item ID is the ID of the submission in assign.xml.
+func processSubmissions(source fs.FS, activitiesFolder string, fileMapping map[string]File) error {
+	// Without the usernames, the submissions are grouped by user ID
+	usernames, err := readUsers(source)
+	if err != nil {
+		Logger.Warn("error reading the users, the submissions are grouped by user ID", "error", err)
+		usernames = make(map[string]string)
+	}
+
+	// Read the activities folder
+	dirs, err := fs.ReadDir(source, activitiesFolder)
+	if err != nil {
+		return fmt.Errorf("error reading activities folder: %w", err)
+	}
+
+	for _, dir := range dirs {
+		if !strings.HasPrefix(dir.Name(), "assign_") {
+			continue
+		}
+		folderPath := path.Join(activitiesFolder, dir.Name())
+
+		// Read the assignment and its submissions
+		assignName, submissions, err := readSubmissions(source, folderPath)
+		if err != nil {
+			Logger.Warn("error reading the assignment", "activity", folderPath, "error", err)
+			continue
+		}
+
+		// Read the file references from the inforef.xml file
+		fileIDs, err := readInforef(source, folderPath)
+		if err != nil {
+			Logger.Warn("error reading the file references", "activity", folderPath, "error", err)
+			continue
+		}
+
+		// Assign the folder of its user to each submitted file
+		for _, id := range fileIDs {
+			file, exists := fileMapping[id]
+			if !exists || !strings.HasPrefix(file.Component, "assignsubmission_") {
+				continue
+			}
+			// The user of the submission, or else the owner of the file
+			userid, ok := submissions[file.Itemid]
+			if !ok || userid == "" {
+				userid = file.Userid
+			}
+			user := userid
+			if username, ok := usernames[userid]; ok {
+				user = username
+			}
+			if user == "" {
+				Logger.Warn("unknown user of the submitted file", "id", id, "activity", folderPath)
+				continue
+			}
+
+			file.Folder = path.Join(sanitizeFileName(assignName), SubmissionsFolder, sanitizeFileName(user))
+			file.Activity = folderPath
+			fileMapping[id] = file
+			Logger.Debug("assigned folder", "id", id, "folder", file.Folder)
+		}
+	}
+	return nil
+}
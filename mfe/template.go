@@ -0,0 +1,80 @@
+package mfe
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// nameData are the fields of a file available in the name template.
+type nameData struct {
+	ID       string // ID of the file in files.xml
+	Hash     string // content hash of the file
+	Filename string // sanitized filename
+	Base     string // filename without its extension
+	Ext      string // extension of the filename, with its dot (like .pdf)
+	Folder   string // folder of the file, with its section if any
+	Section  string // section of the file (with --sections)
+	Filepath string // subfolders of the file in its folder
+}
+
+// nameTemplates caches the parsed name templates by their text.
+var nameTemplates sync.Map
+
+// parseNameTemplate parses a name template, and checks that it can be executed.
+func parseNameTemplate(text string) (*template.Template, error) {
+	if cached, ok := nameTemplates.Load(text); ok {
+		return cached.(*template.Template), nil
+	}
+	tmpl, err := template.New("name").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --name-template: %w", err)
+	}
+	// Catch the unknown fields before extracting
+	if err := tmpl.Execute(&strings.Builder{}, nameData{}); err != nil {
+		return nil, fmt.Errorf("invalid --name-template: %w", err)
+	}
+	nameTemplates.Store(text, tmpl)
+	return tmpl, nil
+}
+
+// templatePath renders the name template for a file in the given folder,
+// and returns the slash-separated path relative to the destination folder.
+// Each part of the path is sanitized, and the empty, . and .. parts are removed.
+func templatePath(text string, file File, folder string) (string, error) {
+	tmpl, err := parseNameTemplate(text)
+	if err != nil {
+		return "", err
+	}
+
+	ext := path.Ext(file.Filename)
+	data := nameData{
+		ID:       file.ID,
+		Hash:     file.ContentHash,
+		Filename: file.Filename,
+		Base:     strings.TrimSuffix(file.Filename, ext),
+		Ext:      ext,
+		Folder:   path.Join(file.Section, folder),
+		Section:  file.Section,
+		Filepath: sanitizeFilepath(file.Filepath),
+	}
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("error rendering --name-template for file %s: %w", file.ID, err)
+	}
+
+	var parts []string
+	for _, part := range strings.Split(rendered.String(), "/") {
+		part = sanitizeFileName(part)
+		if strings.Trim(part, ".") == "" {
+			continue
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("empty --name-template result for file %s", file.ID)
+	}
+	return path.Join(parts...), nil
+}
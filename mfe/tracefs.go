@@ -0,0 +1,52 @@
+package mfe
+
+import (
+	"context"
+	"io/fs"
+	"log/slog"
+)
+
+// tracedFS is a source that logs each access (Open, ReadDir and Stat) and its result at the debug level,
+// to see which paths were tried, like the blob lookups of a missing file.
+type tracedFS struct {
+	source fs.FS
+}
+
+// traced returns the source wrapped in a tracedFS if the debug messages are logged,
+// otherwise the source itself, so that the tracing costs nothing when it is off.
+func traced(source fs.FS) fs.FS {
+	if !Logger.Enabled(context.Background(), slog.LevelDebug) {
+		return source
+	}
+	return &tracedFS{source: source}
+}
+
+// trace logs an access to the source and its error, if any.
+func trace(operation string, name string, err error) {
+	if err != nil {
+		Logger.Debug("source "+operation, "path", name, "error", err)
+		return
+	}
+	Logger.Debug("source "+operation, "path", name)
+}
+
+// Open implements fs.FS.
+func (t *tracedFS) Open(name string) (fs.File, error) {
+	file, err := t.source.Open(name)
+	trace("open", name, err)
+	return file, err
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (t *tracedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := fs.ReadDir(t.source, name)
+	trace("readdir", name, err)
+	return entries, err
+}
+
+// Stat implements fs.StatFS.
+func (t *tracedFS) Stat(name string) (fs.FileInfo, error) {
+	info, err := fs.Stat(t.source, name)
+	trace("stat", name, err)
+	return info, err
+}